@@ -44,15 +44,22 @@ import (
 // They can be used as interim datasets for data streaming queries.
 // They can hold your code temporarily as a backup until it is committed.
 // They can be a low latency part of your continuous delivery pipeline.
-// Want to extend a bag period? Let it delete and create a new one. Reason? Newly generated ids are safer.
-
-// TODO Seek and put into the middle of a tarball
+// Want to extend a bag period? Renew it with a coin, or rotate it into a newly generated id. Reason? Newly generated ids are safer.
 
 func Setup() {
 	stateful.RegisterModuleForBackup(&bags)
+	stateful.RegisterModuleForBackup(&shares)
+	stateful.RegisterModuleForBackup(&raids)
+	stateful.RegisterModuleForBackup(&uploads)
+	setupStorage()
+	setupShares()
+	setupRenewal()
+	setupNotifications()
+	setupRaid()
+	setupUploads()
 
 	http.HandleFunc("/bag.html", func(w http.ResponseWriter, r *http.Request) {
-		if nil == mesh.RedirectToPeerServer(w, r) {
+		if nil == redirectToBagServer(w, r) {
 			return
 		}
 		err := drawing.EnsureAPIKey(w, r)
@@ -63,21 +70,59 @@ func Setup() {
 	})
 
 	http.HandleFunc("/bag.png", func(w http.ResponseWriter, r *http.Request) {
-		if nil == mesh.RedirectToPeerServer(w, r) {
+		if nil == redirectToBagServer(w, r) {
 			return
 		}
 		drawing.ServeRemoteFrame(w, r, declareForm)
 	})
 
 	http.HandleFunc("/tmp.coin", func(w http.ResponseWriter, r *http.Request) {
-		if nil == mesh.RedirectToPeerServer(w, r) {
+		if nil == redirectToBagServer(w, r) {
 			return
 		}
 		// Setup burst sessions, a range of time, when a coin can be used for bursts.
 		if r.Method == "PUT" {
-			coinToUse := billing.ValidatedCoinContent(w, r)
+			if !hasStorageForNewBag() {
+				if nil == mesh.ForwardToNodeWithStorage(w, r, 0) {
+					return
+				}
+				management.QuantumGradeAuthorization()
+				w.WriteHeader(http.StatusInsufficientStorage)
+				return
+			}
+			units := requestedUnits(r)
+			mode, shards := requestedRaid(r)
+			if shards != 0 && !isValidRaid(mode, shards) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if shards != 0 {
+				used := billing.RedeemCoinKeys(r.URL.Query().Get("apikey"), r.Body, int(units))
+				if len(used) == 0 {
+					management.QuantumGradeAuthorization()
+					w.WriteHeader(http.StatusPaymentRequired)
+					return
+				}
+				raid := drawing.GenerateUniqueKey()
+				if makeRaidInternal(raid, mode, shards, units) != nil {
+					billing.RefundCoinUnits(used)
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				management.QuantumGradeAuthorization()
+				_, _ = w.Write([]byte(raid))
+				return
+			}
+			coinToUse := billing.ValidatedCoinUnits(w, r, int(units))
 			if coinToUse != "" {
-				bag := MakeBagInternal(coinToUse)
+				var bag string
+				if r.URL.Query().Get("encrypt") != "" {
+					bag = MakeEncryptedBagInternal(drawing.GenerateUniqueKey())
+				} else {
+					bag = MakeBagInternal(coinToUse)
+				}
+				storageKey, _ := resolveBag(bag)
+				setBagQuota(storageKey, units)
 				management.QuantumGradeAuthorization()
 				_, _ = w.Write([]byte(bag))
 				return
@@ -89,7 +134,8 @@ func Setup() {
 
 		if r.Method == "GET" {
 			apiKey := r.URL.Query().Get("apikey")
-			session, sessionValid := bags[apiKey]
+			bag, _ := resolveBag(apiKey)
+			session, sessionValid := bags[bag]
 			if !sessionValid {
 				management.QuantumGradeAuthorization()
 				w.WriteHeader(http.StatusPaymentRequired)
@@ -102,14 +148,22 @@ func Setup() {
 	})
 
 	http.HandleFunc("/tmp", func(w http.ResponseWriter, r *http.Request) {
-		if nil == mesh.RedirectToPeerServer(w, r) {
+		if nil == redirectToBagServer(w, r) {
 			return
 		}
 		apiKey := r.URL.Query().Get("apikey")
 
-		bag := apiKey
-		if !mesh.CheckExpiry(bag) {
+		name := r.URL.Query().Get("name")
+		_, isShare := shares[indexKey(apiKey)]
+		if !isShare && !mesh.CheckExpiry(indexKey(apiKey)) {
 			r.Method = "DELETE"
+			name = ""
+		}
+		bag, key, access := resolveAccess(apiKey)
+		if !accessAllows(access, r.Method) {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
 
 		traces := bags[bag]
@@ -118,38 +172,155 @@ func Setup() {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		fileName := bag
-		p := path.Join(fmt.Sprintf("/tmp/%s", fileName))
-		if r.Method == "GET" {
+		p := GetBagPathInternal(bag)
+		if name != "" {
+			if r.Method == "GET" && isBagObjectListing(name) {
+				management.QuantumGradeAuthorization()
+				w.Header().Set("Content-Type", "text/plain")
+				writeBagObjectList(w, bag, key, name)
+				return
+			}
+			p = GetBagObjectPathInternal(bag, name)
+			if p == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.Method == "PUT" || r.Method == "PATCH" {
+				drawing.NoErrorVoid(os.MkdirAll(path.Dir(p), 0700))
+			}
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
 			management.QuantumGradeAuthorization()
+			if r.URL.Query().Get("versions") != "" {
+				w.Header().Set("Content-Type", "text/plain")
+				writeBagVersionList(w, bag, name, key)
+				return
+			}
+			version := r.URL.Query().Get("version")
+			if version != "" {
+				p = getBagVersionPath(bag, name, englang.Decimal(version))
+				_, err := os.Stat(p)
+				if err != nil {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+			}
+			if serveTarball(w, r, p, key) {
+				return
+			}
+			if version == "" {
+				status := checkPreconditions(r, bagETag(bag, name, p, key))
+				writeRecordedDigestHeader(w, bag, name)
+				if status != 0 {
+					w.WriteHeader(status)
+					return
+				}
+			}
+			if key != nil {
+				serveEncryptedFile(w, r, p, key)
+				return
+			}
 			http.ServeFile(w, r, p)
 			return
 		}
 		if r.Method == "TRACE" {
 			bw := bufio.NewWriter(w)
-			size := int64(0)
-			stat, err := os.Stat(p)
-			if err != nil {
-				size = 0
-			}
-			size = stat.Size()
+			size := bagSize(p, key)
 			drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("This is a bag storage of a single file\n")))
 			drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("The current size is %d bytes.\n", size)))
+			drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("The bag uses %d bytes of its %d bytes quota.\n", bagUsage(bag), getBagQuota(bag))))
+			if getBagDigest(bag, name) != "" {
+				drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("The SHA-256 checksum is %s.\n", getBagDigest(bag, name))))
+			}
+			drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("The bag has %d named objects.\n", len(listBagObjects(bag, "")))))
 			drawing.NoErrorWrite(bw.WriteString(fmt.Sprintf("bag record follows\n%s\n", bags[bag])))
+			if r.URL.Query().Get("list") != "" {
+				drawing.NoErrorWrite(bw.WriteString("tarball members follow\n"))
+				drawing.NoErrorVoid(listTarball(bw, p, key))
+			}
 			drawing.NoErrorVoid(bw.Flush())
 			return
 		}
-		if r.Method == "PUT" || r.Method == "DELETE" {
-			drawing.NoErrorVoid(os.Remove(p))
+		if r.Method == "PUT" || r.Method == "PATCH" || r.Method == "DELETE" || r.Method == "MOVE" || r.Method == "COPY" {
+			target := ""
+			if r.Method == "MOVE" || r.Method == "COPY" {
+				target, _, _ = resolveAccess(requestedDestination(r))
+				if bags[target] == "" {
+					target = ""
+				}
+			}
+			unlock := lockBags(bag, target)
+			defer unlock()
+			if bags[bag] == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			etag := ""
+			if hasPreconditions(r) {
+				etag = bagETag(bag, name, p, key)
+			}
+			status := checkPreconditions(r, etag)
+			if status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		if r.Method == "PUT" && r.URL.Query().Get("rollback") != "" {
+			status := rollbackBag(bag, name, p, key, englang.Decimal(r.URL.Query().Get("rollback")))
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			writeDigestHeader(w, updateBagDigest(bag, name, p, key))
+			return
+		}
+		if r.Method == "PUT" || r.Method == "PATCH" {
+			if !hasStorageForUpload(r.ContentLength) {
+				w.WriteHeader(http.StatusInsufficientStorage)
+				return
+			}
+			allowance := uploadAllowance(bag, r, p)
+			if r.ContentLength > allowance {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			limited := &quotaReader{reader: r.Body, left: allowance}
+			r.Body = limited
+			body, err := verifiedBody(r, p)
+			if err != nil && limited.exceeded {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			defer func() { _ = body.Close() }()
+			r.Body = body
+			status := uploadBag(r, bag, name, p, key)
+			if limited.exceeded {
+				status = http.StatusRequestEntityTooLarge
+			}
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			if isInPlaceWrite(r) && r.URL.Query().Get("member") == "" {
+				invalidateBagDigest(bag, name)
+				return
+			}
+			writeDigestHeader(w, updateBagDigest(bag, name, p, key))
+			return
 		}
-		if r.Method == "PUT" {
-			f := drawing.NoErrorFile(os.Create(p))
-			defer func() { _ = f.Close() }()
-			drawing.NoErrorWrite64(io.Copy(f, r.Body))
+		if r.Method == "COPY" || r.Method == "MOVE" {
+			status := transferBag(bag, key, name, requestedDestination(r), r.Method == "MOVE")
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+			}
 			return
 		}
 		if r.Method == "DELETE" {
-			delete(bags, bag)
+			deleteBagContent(bag, name)
 			return
 		}
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -160,21 +331,72 @@ func Setup() {
 			if len(bags) > 0 {
 				nanos := time.Duration(metadata.CheckpointPeriod.Nanoseconds() / int64(len(bags)))
 				for bag := range bags {
+					WarnExpiringBag(bag)
 					CleanupExpiredbag(bag)
 					time.Sleep(nanos)
 				}
 			}
+			for stored := range shares {
+				CleanupExpiredShare(stored)
+			}
+			for raid := range raids {
+				CleanupExpiredRaid(raid)
+			}
+			for id := range uploads {
+				CleanupExpiredUpload(id)
+			}
 			time.Sleep(metadata.CheckpointPeriod)
 		}
 	}()
 }
 
+func uploadBag(r *http.Request, bag string, name string, p string, key []byte) int {
+	handled, status := false, http.StatusOK
+	if r.Method == "PUT" && r.URL.Query().Get("member") != "" {
+		keepBagVersion(bag, name, p)
+		handled, status = replaceMember(r, p, key)
+	}
+	if !handled {
+		handled, status = partialWrite(r, p, key)
+	}
+	if !handled && r.Method == "PUT" {
+		if replaceBagFile(bag, name, p, key, r.Body) != nil {
+			return http.StatusInternalServerError
+		}
+	}
+	return status
+}
+
+// deleteBagContent deletes a named object, or the whole bag, if there is no name.
+func deleteBagContent(bag string, name string) {
+	p := GetBagPathInternal(bag)
+	if name != "" {
+		p = GetBagObjectPathInternal(bag, name)
+	}
+	drawing.NoErrorVoid(os.Remove(p))
+	setBagRecordLine(bag, digestRecordPrefix(name), "")
+	if name != "" {
+		updateStorageUsage(bag)
+		return
+	}
+	deleteBagObjects(bag)
+	deleteBagVersions(bag)
+	delete(bags, bag)
+	forgetBagLock(bag)
+	forgetStorageUsage(bag)
+}
+
 func CleanupExpiredbag(bag string) {
 	valid := mesh.GetIndex(bag)
 	if valid == "" {
-		path1 := path.Join(fmt.Sprintf("/tmp/%s", bag))
+		notifyDeletedBag(bag, bags[bag])
+		path1 := GetBagPathInternal(bag)
 		_ = os.Remove(path1)
+		deleteBagObjects(bag)
+		deleteBagVersions(bag)
 		delete(bags, bag)
+		forgetBagLock(bag)
+		forgetStorageUsage(bag)
 	}
 }
 
@@ -200,13 +422,26 @@ func MakebagWithCoin(coinUrlList string) string {
 
 func declareForm(session *drawing.Session) {
 	if session.Form.Boxes == nil {
-		drawing.DeclareForm(session, "./bag/media/page.png")
+		existing, _ := resolveBag(session.ApiKey)
+		if bags[existing] != "" {
+			drawing.DeclareForm(session, "./bag/media/preview.png")
+		} else {
+			drawing.DeclareForm(session, "./bag/media/page.png")
+		}
 
 		init := "Click here to pay with a coin file."
-		if bags[session.ApiKey] != "" {
-			init = "Click here to preview bag."
+		if bags[existing] != "" {
+			init = "Click here to download bag."
 		}
 		CommandText := drawing.PutText(session, -1, drawing.Content{Text: init, Lines: 1, Editable: false, Selectable: false, FontColor: drawing.Black, BackgroundColor: drawing.White, Alignment: 0})
+		if bags[existing] != "" {
+			summary, lines, img := previewBag(session.ApiKey)
+			drawing.PutText(session, -1, drawing.Content{Text: summary, Lines: 5, Editable: false, Selectable: false, FontColor: drawing.Black, BackgroundColor: drawing.White, Alignment: 1})
+			Lines := drawing.PutText(session, -1, drawing.Content{Text: lines, Lines: previewLines, Editable: false, Selectable: false, FontColor: drawing.Black, BackgroundColor: drawing.White, Alignment: 1})
+			if img != nil {
+				drawing.PutImage(session, Lines+1, thumbnail(img, session.Form.Boxes[Lines+1]), drawing.Content{Text: "", Lines: 1, Editable: false, Selectable: false})
+			}
+		}
 
 		session.SignalClicked = func(session *drawing.Session, i int) {
 			if i == CommandText {
@@ -216,7 +451,7 @@ func declareForm(session *drawing.Session) {
 				if session.Text[CommandText].Text == "Click here to upload content." {
 					session.Upload = "*.*"
 				}
-				if session.Text[CommandText].Text == "Click here to preview bag." && bags[session.ApiKey] != "" {
+				if session.Text[CommandText].Text == "Click here to download bag." && bags[existing] != "" {
 					session.Redirect = fmt.Sprintf("/tmp?apikey=%s", session.ApiKey)
 					session.SelectedBox = -1
 				}
@@ -227,7 +462,7 @@ func declareForm(session *drawing.Session) {
 		session.SignalUploaded = func(session *drawing.Session, upload drawing.Upload) {
 			if session.Text[CommandText].Text == "Click here to pay with a coin file." {
 				// session.Data is going to the voucher id
-				session.Data = MakebagWithCoin(string(upload.Body))
+				session.Data = MakebagWithCoin(string(drawing.NoErrorBytes(io.ReadAll(io.LimitReader(upload.Body, maxCoinSize)))))
 				if session.Data != "" {
 					drawing.PutText(session, CommandText, drawing.Content{Text: "Click here to upload content.", Lines: 1, Editable: false, Selectable: false, FontColor: drawing.Black, BackgroundColor: drawing.White, Alignment: 0})
 					session.SignalPartialRedrawNeeded(session, CommandText)
@@ -239,12 +474,29 @@ func declareForm(session *drawing.Session) {
 					session.SignalPartialRedrawNeeded(session, CommandText)
 				}
 			}
+			if session.Text[CommandText].Text == "Click here to upload content." && session.Data != "" && upload.Length > getBagQuota(session.Data) {
+				data := session.Text[CommandText]
+				data.Text = "The file is larger than the bag. Click refresh."
+				session.Text[CommandText] = data
+				session.SignalPartialRedrawNeeded(session, CommandText)
+				return
+			}
 			if session.Text[CommandText].Text == "Click here to upload content." && session.Data != "" {
 				// session.Data is the voucher id
 				bag := session.Data
-				fileName := bag
-				p := path.Join(fmt.Sprintf("/tmp/%s", fileName))
-				_ = os.WriteFile(p, upload.Body, 0700)
+				p := GetBagPathInternal(bag)
+				limited := &quotaReader{reader: upload.Body, left: getBagQuota(bag)}
+				unlock := lockBag(bag)
+				err := replaceBagFile(bag, "", p, nil, limited)
+				updateBagDigest(bag, "", p, nil)
+				unlock()
+				if err != nil || limited.exceeded {
+					data := session.Text[CommandText]
+					data.Text = "The file could not be uploaded. Click refresh."
+					session.Text[CommandText] = data
+					session.SignalPartialRedrawNeeded(session, CommandText)
+					return
+				}
 				session.Data = ""
 
 				data := session.Text[CommandText]
@@ -265,22 +517,19 @@ func declareForm(session *drawing.Session) {
 
 func MakeBagInternal(bag string) string {
 	bags[bag] = "Bag is valid."
+	setBagQuota(bag, 1)
 	mesh.RegisterIndex(bag)
 	mesh.SetExpiry(bag, ValidPeriod)
-	path1 := path.Join(fmt.Sprintf("/tmp/%s", bag))
+	path1 := GetBagPathInternal(bag)
 	bagFile := drawing.NoErrorFile(os.Create(path1))
 	w := bufio.NewWriter(bagFile)
 	_, _ = w.WriteString(fmt.Sprintf("curl -X GET %s/tmp?apikey=%s", metadata.SiteUrl, bag))
 	_ = w.Flush()
 	_ = bagFile.Close()
+	updateBagDigest(bag, "", path1, nil)
 	return bag
 }
 
-func GetBagPathInternal(bag string) string {
-	fileName := bag
-	return path.Join(fmt.Sprintf("/tmp/%s", fileName))
-}
-
 func GetBagInternal(bag string) []byte {
 	return drawing.NoErrorBytes(os.ReadFile(GetBagPathInternal(bag)))
 }
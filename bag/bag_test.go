@@ -0,0 +1,812 @@
+package bag
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+func TestPartialWrite(t *testing.T) {
+	p := path.Join(t.TempDir(), "bag")
+	_ = os.WriteFile(p, []byte("Hello World!"), 0700)
+
+	r, _ := http.NewRequest("PATCH", "/tmp?apikey=test", bytes.NewBufferString("Moon!"))
+	r.Header.Set("Content-Range", "bytes 6-10/*")
+	offset, length, partial, err := requestedOffset(r)
+	if err != nil || !partial || offset != 6 || length != 5 {
+		t.Error("content range", offset, length, partial, err)
+	}
+	if writeBagAt(p, nil, offset, length, r.Body) != nil {
+		t.Error("write")
+	}
+	if appendBag(p, nil, bytes.NewBufferString(" Bye!")) != nil {
+		t.Error("append")
+	}
+	content, _ := os.ReadFile(p)
+	if string(content) != "Hello Moon!! Bye!" {
+		t.Error(string(content))
+	}
+
+	if writeBagAt(p, nil, 100, -1, bytes.NewBufferString("hole")) == nil {
+		t.Error("holes are not allowed")
+	}
+	r, _ = http.NewRequest("PUT", "/tmp?apikey=test&offset=-1", nil)
+	_, _, _, err = requestedOffset(r)
+	if err == nil {
+		t.Error("negative offset")
+	}
+}
+
+func TestTarballMembers(t *testing.T) {
+	p := path.Join(t.TempDir(), "bag")
+	f, _ := os.Create(p)
+	zipper := gzip.NewWriter(f)
+	writer := tar.NewWriter(zipper)
+	_ = writer.WriteHeader(&tar.Header{Name: "reports/", Typeflag: tar.TypeDir, Mode: 0700})
+	_ = writer.WriteHeader(&tar.Header{Name: "reports/q3.csv", Typeflag: tar.TypeReg, Mode: 0600, Size: 3})
+	_, _ = writer.Write([]byte("abc"))
+	_ = writer.Close()
+	_ = zipper.Close()
+	_ = f.Close()
+
+	if replaceTarballMember(p, nil, "reports/q3.csv", bytes.NewBufferString("abcdef")) != nil {
+		t.Error("replace")
+	}
+	if replaceTarballMember(p, nil, "reports/q4.csv", bytes.NewBufferString("xyz")) != nil {
+		t.Error("add")
+	}
+	list := bytes.Buffer{}
+	if listTarball(&list, p, nil) != nil {
+		t.Error("list")
+	}
+	if list.String() != "Directory reports/.\nFile reports/q3.csv has 6 bytes.\nFile reports/q4.csv has 3 bytes.\n" {
+		t.Error(list.String())
+	}
+	var content []byte
+	_ = findTarballMember(p, nil, "reports/q3.csv", func(header *tar.Header, r io.Reader) error {
+		content, _ = io.ReadAll(r)
+		return nil
+	})
+	if string(content) != "abcdef" {
+		t.Error(string(content))
+	}
+	if findTarballMember(p, nil, "missing", func(header *tar.Header, r io.Reader) error { return nil }) == nil {
+		t.Error("missing member found")
+	}
+
+	plain := path.Join(t.TempDir(), "plain")
+	_ = os.WriteFile(plain, []byte("not a tarball"), 0600)
+	w := httptest.NewRecorder()
+	serveTarball(w, httptest.NewRequest("GET", "/tmp?apikey=ABC&list=1", nil), plain, nil)
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != "The bag is not a tarball.\n" {
+		t.Error(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	serveTarball(w, httptest.NewRequest("GET", "/tmp?apikey=ABC&member=missing", nil), p, nil)
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Error(w.Code, w.Body.String())
+	}
+}
+
+func TestNamedObjects(t *testing.T) {
+	bag := "TESTNAMEDOBJECTS"
+	defer deleteBagObjects(bag)
+	if GetBagObjectPathInternal(bag, "../../etc/passwd") != path.Join(GetBagPathInternal(bag)+".objects", "etc", "passwd") {
+		t.Error("path traversal")
+	}
+	if GetBagObjectPathInternal(bag, "/") != "" {
+		t.Error("empty name")
+	}
+	for _, name := range []string{"reports/q3.csv", "reports/q4.csv", "readme.txt"} {
+		p := GetBagObjectPathInternal(bag, name)
+		_ = os.MkdirAll(path.Dir(p), 0700)
+		_ = os.WriteFile(p, []byte(name), 0700)
+	}
+	list := bytes.Buffer{}
+	writeBagObjectList(&list, bag, nil, "reports/")
+	if list.String() != "Object reports/q3.csv has 14 bytes.\nObject reports/q4.csv has 14 bytes.\n" {
+		t.Error(list.String())
+	}
+	if len(listBagObjects(bag, "")) != 3 {
+		t.Error(listBagObjects(bag, ""))
+	}
+}
+
+func TestUploadDigest(t *testing.T) {
+	p := path.Join(t.TempDir(), "bag")
+	r, _ := http.NewRequest("PUT", "/tmp?apikey=test", bytes.NewBufferString("abc"))
+	r.Header.Set("Digest", "SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=")
+	body, err := verifiedBody(r, p)
+	if err != nil {
+		t.Error(err)
+	} else {
+		content, _ := io.ReadAll(body)
+		if string(content) != "abc" {
+			t.Error(string(content))
+		}
+	}
+
+	r, _ = http.NewRequest("PUT", "/tmp?apikey=test", bytes.NewBufferString("abd"))
+	r.Header.Set("Content-MD5", "kAFQmDzST7DWlj99KOF/cg==")
+	_, err = verifiedBody(r, p)
+	if err == nil {
+		t.Error("corruption not detected")
+	}
+
+	bag := "TESTUPLOADDIGEST"
+	bags[bag] = "Bag is valid.\nVoucher used: ABCDEF\n"
+	defer delete(bags, bag)
+	_ = os.WriteFile(p, []byte("abc"), 0700)
+	updateBagDigest(bag, "", p, nil)
+	updateBagDigest(bag, "", p, nil)
+	if getBagDigest(bag, "") != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Error(bags[bag])
+	}
+	if strings.Count(bags[bag], "SHA-256") != 1 {
+		t.Error(bags[bag])
+	}
+
+	appended, _ := http.NewRequest("PATCH", "/tmp?apikey=test", nil)
+	replaced, _ := http.NewRequest("PUT", "/tmp?apikey=test", nil)
+	if !isInPlaceWrite(appended) || isInPlaceWrite(replaced) || hasPreconditions(appended) {
+		t.Error("in place writes")
+	}
+	_ = os.WriteFile(p, []byte("abcd"), 0700)
+	invalidateBagDigest(bag, "")
+	if getBagDigest(bag, "") != "" {
+		t.Error("appended digest was kept")
+	}
+	if bagETag(bag, "", p, nil) != "\"88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589\"" {
+		t.Error(bags[bag])
+	}
+}
+
+func TestEncryptedBag(t *testing.T) {
+	p := path.Join(t.TempDir(), "bag")
+	key := bagCipherKey("TESTENCRYPTEDBAG")
+	plain := bytes.Repeat([]byte("0123456789abcdef"), 5)
+	f, _ := createBagWriter(p, key)
+	_, _ = f.Write(plain[:40])
+	_ = f.Close()
+	if appendBag(p, key, bytes.NewBuffer(plain[40:])) != nil {
+		t.Error("append")
+	}
+	before, _ := os.ReadFile(p)
+	if writeBagAt(p, key, 17, 3, bytes.NewBufferString("XYZ")) != nil {
+		t.Error("write")
+	}
+	copy(plain[17:], "XYZ")
+
+	raw, _ := os.ReadFile(p)
+	if len(raw) != len(plain)+28 || bytes.Contains(raw, []byte("0123456789")) {
+		t.Error("not encrypted")
+	}
+	if bytes.Equal(raw[:12], before[:12]) {
+		t.Error("nonce reused")
+	}
+	r, _ := openBagReader(p, key)
+	content, _ := io.ReadAll(r)
+	if !bytes.Equal(content, plain) {
+		t.Error(string(content))
+	}
+	_, _ = r.Seek(33, io.SeekStart)
+	part := make([]byte, 10)
+	_, _ = io.ReadFull(r, part)
+	if !bytes.Equal(part, plain[33:43]) {
+		t.Error(string(part))
+	}
+	_ = r.Close()
+	if bagSize(p, key) != int64(len(plain)) {
+		t.Error(bagSize(p, key))
+	}
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), encryptedChunk/8+5)
+	f, _ = createBagWriter(p, key)
+	_, _ = f.Write(large)
+	_ = f.Close()
+	if writeBagAt(p, key, encryptedChunk-2, 4, bytes.NewBufferString("WXYZ")) != nil {
+		t.Error("write across chunks")
+	}
+	copy(large[encryptedChunk-2:], "WXYZ")
+	r, _ = openBagReader(p, key)
+	content, _ = io.ReadAll(r)
+	_ = r.Close()
+	if !bytes.Equal(content, large) || bagSize(p, key) != int64(len(large)) {
+		t.Error("chunks")
+	}
+
+	raw, _ = os.ReadFile(p)
+	raw[len(raw)-20] ^= 1
+	_ = os.WriteFile(p, raw, 0700)
+	r, _ = openBagReader(p, key)
+	_, err := io.ReadAll(r)
+	_ = r.Close()
+	if err == nil {
+		t.Error("modified content was read")
+	}
+}
+
+func TestBagQuota(t *testing.T) {
+	bag := "TESTBAGQUOTA"
+	bags[bag] = "Bag is valid."
+	defer delete(bags, bag)
+	setBagQuota(bag, 2)
+	if getBagQuota(bag) != 2*metadata.BagQuota {
+		t.Error(bags[bag])
+	}
+	metadata.BagQuota = 5
+	defer func() { metadata.BagQuota = 1024 * 1024 * 1024 }()
+	setBagQuota(bag, 2)
+
+	p := GetBagPathInternal(bag)
+	_ = os.WriteFile(p, []byte("abcd"), 0700)
+	defer func() { _ = os.Remove(p) }()
+	r, _ := http.NewRequest("PUT", "/tmp?apikey="+bag, nil)
+	if uploadAllowance(bag, r, p) != 10 {
+		t.Error(uploadAllowance(bag, r, p))
+	}
+	r, _ = http.NewRequest("PATCH", "/tmp?apikey="+bag, nil)
+	if uploadAllowance(bag, r, p) != 6 {
+		t.Error(uploadAllowance(bag, r, p))
+	}
+
+	limited := &quotaReader{reader: bytes.NewBufferString("0123456789"), left: 6}
+	_, err := io.ReadAll(limited)
+	if err == nil || !limited.exceeded {
+		t.Error("quota not enforced")
+	}
+	limited = &quotaReader{reader: bytes.NewBufferString("012345"), left: 6}
+	content, err := io.ReadAll(limited)
+	if err != nil || limited.exceeded || string(content) != "012345" {
+		t.Error(string(content))
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	bag := bagFingerprint("TESTDERIVEDKEYS")
+	bags[bag] = "Bag is valid.\n" + encryptedMarker
+	defer delete(bags, bag)
+	key := bagCipherKey("TESTDERIVEDKEYS")
+
+	reader := makeShareInternal(bag, key, accessRead, time.Hour)
+	writer := makeShareInternal(bag, nil, accessWrite, time.Hour)
+	defer delete(shares, indexKey(reader))
+	defer delete(shares, indexKey(writer))
+	_, stored := shares[reader]
+	if stored || strings.Contains(shares[indexKey(reader)], hex.EncodeToString(key)) {
+		t.Error("content key leaked")
+	}
+	resolved, resolvedKey, access := resolveAccess(reader)
+	if resolved != bag || !bytes.Equal(resolvedKey, key) || access != accessRead {
+		t.Error(resolved, access)
+	}
+	if accessAllows(access, "PUT") || accessAllows(access, "DELETE") || !accessAllows(access, "GET") {
+		t.Error("read only")
+	}
+	_, _, access = resolveAccess(writer)
+	if accessAllows(access, "GET") || !accessAllows(access, "PUT") {
+		t.Error("write only")
+	}
+
+	owner := "TESTDERIVEDKEYSOWNER"
+	bags[owner] = "Bag is valid."
+	defer delete(bags, owner)
+	shared := makeShareInternal(owner, nil, accessRead, time.Hour)
+	defer delete(shares, indexKey(shared))
+	description := getShareDescription(indexKey(shared))
+	if _, stored = shares[shared]; stored || strings.Contains(description, owner) || !strings.HasPrefix(description, "Read only access.") {
+		t.Error("owner key leaked", description)
+	}
+	if resolved, _, access = resolveAccess(shared); resolved != owner || access != accessRead {
+		t.Error(resolved, access)
+	}
+
+	expired := makeShareInternal(bag, nil, accessRead, -time.Hour)
+	defer delete(shares, indexKey(expired))
+	_, _, access = resolveAccess(expired)
+	if accessAllows(access, "GET") {
+		t.Error("expired")
+	}
+}
+
+func TestRotateBag(t *testing.T) {
+	bag := "TESTROTATEBAG"
+	MakeBagInternal(bag)
+	defer func() {
+		deleteBagObjects(bag)
+		deleteBagVersions(bag)
+		_ = os.Remove(GetBagPathInternal(bag))
+		delete(bags, bag)
+	}()
+	setBagQuota(bag, 3)
+	_ = os.WriteFile(GetBagPathInternal(bag), []byte("abc"), 0700)
+	p := GetBagObjectPathInternal(bag, "reports/q3.csv")
+	_ = os.MkdirAll(path.Dir(p), 0700)
+	_ = os.WriteFile(p, []byte("def"), 0700)
+
+	rotated := rotateBagInternal(bag, nil)
+	defer func() { deleteBagObjects(rotated); _ = os.Remove(GetBagPathInternal(rotated)); delete(bags, rotated) }()
+	content, _ := os.ReadFile(GetBagPathInternal(rotated))
+	object, _ := os.ReadFile(GetBagObjectPathInternal(rotated, "reports/q3.csv"))
+	if string(content) != "abc" || string(object) != "def" || getBagQuota(rotated) != 3*metadata.BagQuota {
+		t.Error(bags[rotated])
+	}
+	if getBagDigest(rotated, "reports/q3.csv") == "" {
+		t.Error(bags[rotated])
+	}
+}
+
+func TestExpiryNotification(t *testing.T) {
+	mesh.AllowLocalNotifications = true
+	defer func() { mesh.AllowLocalNotifications = false }()
+	messages := make(chan string, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		messages <- string(body)
+	}))
+	defer hook.Close()
+
+	bag := "TESTNOTIFYBAG"
+	MakeBagInternal(bag)
+	defer func() { _ = os.Remove(GetBagPathInternal(bag)); delete(bags, bag) }()
+	setBagRecordLine(bag, mesh.NotificationPrefix, mesh.NotificationRecordLine(hook.URL, 2*ValidPeriod))
+
+	WarnExpiringBag(bag)
+	select {
+	case m := <-messages:
+		if !strings.Contains(m, "expires on") {
+			t.Error(m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no warning")
+	}
+	WarnExpiringBag(bag)
+	renewBagInternal(bag)
+	if strings.Contains(bags[bag], mesh.ExpiryWarningSent) {
+		t.Error("renewal should rearm the warning")
+	}
+
+	mesh.DeleteIndex(bag)
+	CleanupExpiredbag(bag)
+	select {
+	case m := <-messages:
+		if !strings.Contains(m, "deleted") {
+			t.Error(m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no deletion notice")
+	}
+}
+
+// testNodes are peers of the mesh keeping their shards in memory.
+type testNodes struct {
+	servers []*httptest.Server
+	nodes   map[string]string
+	lock    sync.Mutex
+	shards  map[string][]byte
+}
+
+func newTestNodes(count int) *testNodes {
+	ret := &testNodes{nodes: mesh.Nodes, shards: map[string][]byte{}}
+	mesh.Nodes = map[string]string{}
+	for i := 0; i < count; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ret.lock.Lock()
+			defer ret.lock.Unlock()
+			apiKey := r.URL.Query().Get("apikey")
+			if r.URL.Path == "/tmp.shard" {
+				shard := drawing.GenerateUniqueKey()
+				ret.shards[shard] = []byte{}
+				_, _ = w.Write([]byte(shard))
+				return
+			}
+			content, ok := ret.shards[apiKey]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch r.Method {
+			case "PUT":
+				ret.shards[apiKey], _ = io.ReadAll(r.Body)
+			case "GET":
+				_, _ = w.Write(content)
+			case "DELETE":
+				delete(ret.shards, apiKey)
+			}
+		}))
+		ret.servers = append(ret.servers, server)
+		mesh.Nodes[server.URL] = "This node is ready."
+		mesh.SetIndex(englang.Printf("Storage of node %s", server.URL), englang.Printf("Node has %s bytes free.", englang.DecimalString(metadata.StorageReserve+int64(i+1))))
+	}
+	return ret
+}
+
+func (n *testNodes) Close() {
+	for _, server := range n.servers {
+		mesh.DeleteIndex(englang.Printf("Storage of node %s", server.URL))
+		server.Close()
+	}
+	mesh.Nodes = n.nodes
+}
+
+func TestRedundantBag(t *testing.T) {
+	nodes := newTestNodes(3)
+	defer nodes.Close()
+	if makeRaidInternal("TESTRAIDTOOMANY", raidMirror, 4, 1) == nil || raids["TESTRAIDTOOMANY"] != "" {
+		t.Error("shards were placed on the same node")
+	}
+	for _, mode := range []string{raidMirror, raidParity} {
+		raid := "TESTRAIDBAG"
+		if makeRaidInternal(raid, mode, 3, 1) != nil {
+			t.Error("make", mode)
+		}
+		placed := map[string]bool{}
+		_, placedShards, _ := getRaid(raid)
+		for _, shard := range placedShards {
+			placed[shard.node] = true
+		}
+		if len(placed) != 3 {
+			t.Error("shards share nodes", raids[raid])
+		}
+		if writeRaidInternal(raid, bytes.NewBufferString("Hello World!!"), -1) != http.StatusOK {
+			t.Error("write", mode)
+		}
+		if writeRaidInternal(raid, bytes.NewBufferString("Hello World!!"), raidCapacity(raid)+1) != http.StatusRequestEntityTooLarge {
+			t.Error("quota", mode)
+		}
+		_, shards, size := getRaid(raid)
+		if len(shards) != 3 || size != 13 {
+			t.Error(raids[raid])
+		}
+		nodes.lock.Lock()
+		delete(nodes.shards, shards[0].bag)
+		nodes.lock.Unlock()
+		content := bytes.Buffer{}
+		if readRaidInternal(raid, &content) != nil || content.String() != "Hello World!!" {
+			t.Error("read", mode, content.String())
+		}
+		if !strings.Contains(describeRaid(raid), englang.Printf("Shard 0 on node %s is not available.", shards[0].node)) {
+			t.Error(describeRaid(raid))
+		}
+		nodes.lock.Lock()
+		delete(nodes.shards, shards[1].bag)
+		nodes.lock.Unlock()
+		if _, err := openRaidInternal(raid); (err == nil) == (mode == raidParity) {
+			t.Error("missing shards", mode)
+		}
+		deleteRaidInternal(raid)
+		nodes.lock.Lock()
+		_, kept := nodes.shards[shards[2].bag]
+		nodes.lock.Unlock()
+		if kept || raids[raid] != "" {
+			t.Error("delete", mode)
+		}
+	}
+
+	quota := metadata.BagQuota
+	metadata.BagQuota = 4
+	defer func() { metadata.BagQuota = quota }()
+	raid := "TESTRAIDQUOTA"
+	if makeRaidInternal(raid, raidMirror, 2, 1) != nil {
+		t.Error("make")
+	}
+	defer deleteRaidInternal(raid)
+	if writeRaidInternal(raid, bytes.NewBufferString("Hello World!!"), -1) != http.StatusRequestEntityTooLarge {
+		t.Error("quota was not enforced on the spool")
+	}
+}
+
+func TestTransferBag(t *testing.T) {
+	from := "TESTTRANSFERFROM"
+	to := "TESTTRANSFERTO"
+	MakeBagInternal(from)
+	MakeBagInternal(to)
+	defer func() {
+		for _, bag := range []string{from, to} {
+			deleteBagObjects(bag)
+			_ = os.Remove(GetBagPathInternal(bag))
+			delete(bags, bag)
+		}
+	}()
+	_ = os.WriteFile(GetBagPathInternal(from), []byte("abc"), 0700)
+	p := GetBagObjectPathInternal(from, "reports/q3.csv")
+	_ = os.MkdirAll(path.Dir(p), 0700)
+	_ = os.WriteFile(p, []byte("def"), 0700)
+
+	if transferBag(from, nil, "", from, false) != http.StatusConflict {
+		t.Error("copy into itself")
+	}
+	if transferBag(from, nil, "", to, false) != http.StatusOK {
+		t.Error("copy")
+	}
+	content, _ := os.ReadFile(GetBagPathInternal(to))
+	object, _ := os.ReadFile(GetBagObjectPathInternal(to, "reports/q3.csv"))
+	if string(content) != "abc" || string(object) != "def" || getBagDigest(to, "reports/q3.csv") == "" {
+		t.Error(bags[to])
+	}
+
+	_ = os.WriteFile(p, []byte("ghi"), 0700)
+	if transferBag(from, nil, "reports/q3.csv", to, true) != http.StatusOK {
+		t.Error("move")
+	}
+	object, _ = os.ReadFile(GetBagObjectPathInternal(to, "reports/q3.csv"))
+	_, err := os.Stat(p)
+	if string(object) != "ghi" || err == nil || bags[from] == "" {
+		t.Error("moved object", string(object), err)
+	}
+
+	setBagRecordLine(to, "Bag quota is ", "Bag quota is 4 bytes.")
+	_ = os.WriteFile(GetBagPathInternal(from), []byte("abcdefgh"), 0700)
+	if transferBag(from, nil, "", to, false) != http.StatusRequestEntityTooLarge {
+		t.Error("quota")
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	bag := "TESTCHUNKEDUPLOAD"
+	MakeBagInternal(bag)
+	defer func() {
+		deleteBagObjects(bag)
+		deleteBagVersions(bag)
+		_ = os.Remove(GetBagPathInternal(bag))
+		delete(bags, bag)
+	}()
+
+	id := startUploadInternal(bag, "reports/q3.csv", 3)
+	if writeChunkInternal(id, nil, 2, bytes.NewBufferString("World!")) != http.StatusOK {
+		t.Error("chunk 2")
+	}
+	_ = writeChunkInternal(id, nil, 0, bytes.NewBufferString("Hel"))
+	_ = writeChunkInternal(id, nil, 0, bytes.NewBufferString("Hello"))
+	if describeMissingChunks(id, 3) != "1" || commitUploadInternal(id, nil) != http.StatusConflict {
+		t.Error("missing chunks")
+	}
+	_ = writeChunkInternal(id, nil, 1, bytes.NewBufferString(" "))
+	if commitUploadInternal(id, nil) != http.StatusOK {
+		t.Error("commit")
+	}
+	content, _ := os.ReadFile(GetBagObjectPathInternal(bag, "reports/q3.csv"))
+	if string(content) != "Hello World!" || getBagDigest(bag, "reports/q3.csv") == "" {
+		t.Error(string(content))
+	}
+	_, err := os.Stat(getChunksPathInternal(id))
+	if uploads[id] != "" || err == nil {
+		t.Error("upload is not cleaned up")
+	}
+
+	setBagRecordLine(bag, "Bag quota is ", "Bag quota is 20 bytes.")
+	id = startUploadInternal(bag, "", 2)
+	defer deleteUploadInternal(id)
+	_ = writeChunkInternal(id, nil, 0, bytes.NewBufferString("0123456789"))
+	if writeChunkInternal(id, nil, 1, bytes.NewBufferString("0123456789")) != http.StatusRequestEntityTooLarge {
+		t.Error("quota")
+	}
+	if writeChunkInternal(id, nil, 0, bytes.NewBufferString("0")) != http.StatusOK || writeChunkInternal(id, nil, 1, bytes.NewBufferString("1")) != http.StatusOK {
+		t.Error("chunks within the quota")
+	}
+	_ = os.WriteFile(GetBagObjectPathInternal(bag, "reports/q3.csv"), []byte("Hello World! Hello World!"), 0700)
+	if commitUploadInternal(id, nil) != http.StatusRequestEntityTooLarge {
+		t.Error("quota was not checked again on commit")
+	}
+}
+
+func TestPreviewBag(t *testing.T) {
+	bag := "TESTPREVIEWBAG"
+	MakeBagInternal(bag)
+	defer func() { _ = os.Remove(GetBagPathInternal(bag)); delete(bags, bag) }()
+	p := GetBagPathInternal(bag)
+
+	_ = os.WriteFile(p, []byte("first\nsecond\n"), 0700)
+	updateBagDigest(bag, "", p, nil)
+	summary, lines, img := previewBag(bag)
+	if !strings.Contains(summary, "The bag has 13 bytes") || !strings.Contains(summary, getBagDigest(bag, "")) || lines != "first\nsecond" || img != nil {
+		t.Error(summary, lines)
+	}
+
+	f, _ := os.Create(p)
+	_ = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	_ = f.Close()
+	_, lines, img = previewBag(bag)
+	if lines != "Image of 40 by 20 pixels." || img == nil {
+		t.Error(lines)
+	}
+	if thumbnail(img, image.Rect(0, 0, 400, 260)).Bounds().Dx() != 400 {
+		t.Error("thumbnail")
+	}
+
+	f, _ = os.Create(p)
+	zipped := gzip.NewWriter(f)
+	tarball := tar.NewWriter(zipped)
+	for i := 0; i < previewLines; i++ {
+		_ = tarball.WriteHeader(&tar.Header{Name: englang.Printf("member%s.txt", englang.DecimalString(int64(i))), Mode: 0600, Size: 1})
+		_, _ = tarball.Write([]byte("x"))
+	}
+	_ = tarball.Flush()
+	_, _ = zipped.Write(bytes.Repeat([]byte("garbage"), 100))
+	_ = zipped.Close()
+	_ = f.Close()
+	if listTarball(io.Discard, p, nil) == nil {
+		t.Error("garbage was listed")
+	}
+	summary, lines, _ = previewBag(bag)
+	if !strings.Contains(summary, "It is a tarball.") || strings.Count(lines, "\n") != previewLines-1 {
+		t.Error(summary, lines)
+	}
+	limit := maxPreviewSize
+	maxPreviewSize = 100
+	defer func() { maxPreviewSize = limit }()
+	summary, lines, _ = previewBag(bag)
+	if !strings.Contains(summary, "It is too large for a preview.") || lines != "" {
+		t.Error(summary, lines)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestBagVersions(t *testing.T) {
+	bag := "TESTBAGVERSIONS"
+	MakeBagInternal(bag)
+	defer func() { deleteBagVersions(bag); _ = os.Remove(GetBagPathInternal(bag)); delete(bags, bag) }()
+	p := GetBagPathInternal(bag)
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		if replaceBagFile(bag, "", p, nil, bytes.NewBufferString(content)) != nil {
+			t.Error(content)
+		}
+	}
+	versions := listBagVersions(bag, "")
+	if len(versions) != metadata.BagVersions {
+		t.Error(versions)
+	}
+	latest, _ := os.ReadFile(getBagVersionPath(bag, "", versions[len(versions)-1]))
+	if string(latest) != "v3" {
+		t.Error(string(latest))
+	}
+
+	if replaceBagFile(bag, "", p, nil, io.MultiReader(bytes.NewBufferString("broken"), failingReader{})) == nil {
+		t.Error("failed upload")
+	}
+	content, _ := os.ReadFile(p)
+	if string(content) != "v4" {
+		t.Error(string(content))
+	}
+
+	if rollbackBag(bag, "", p, nil, versions[len(versions)-1]) != http.StatusOK {
+		t.Error("rollback")
+	}
+	content, _ = os.ReadFile(p)
+	if string(content) != "v3" {
+		t.Error(string(content))
+	}
+	list := bytes.Buffer{}
+	writeBagVersionList(&list, bag, "", nil)
+	if !strings.Contains(list.String(), "has 2 bytes.") {
+		t.Error(list.String())
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	bag := "TESTCONDITIONALBAG"
+	MakeBagInternal(bag)
+	defer func() { deleteBagVersions(bag); _ = os.Remove(GetBagPathInternal(bag)); delete(bags, bag) }()
+	p := GetBagPathInternal(bag)
+	_ = os.WriteFile(p, []byte("review"), 0700)
+	updateBagDigest(bag, "", p, nil)
+	etag := bagETag(bag, "", p, nil)
+	if etag != "\""+getBagDigest(bag, "")+"\"" {
+		t.Error(etag)
+	}
+
+	r, _ := http.NewRequest("PUT", "/tmp?apikey=test", nil)
+	r.Header.Set("If-Match", etag)
+	if checkPreconditions(r, etag) != 0 {
+		t.Error("matching write")
+	}
+	r.Header.Set("If-Match", "\"stale\", W/"+etag)
+	if checkPreconditions(r, etag) != http.StatusPreconditionFailed {
+		t.Error("stale write")
+	}
+	r.Header.Del("If-Match")
+	r.Header.Set("If-None-Match", "*")
+	if checkPreconditions(r, etag) != http.StatusPreconditionFailed || checkPreconditions(r, bagETag(bag, "missing", GetBagObjectPathInternal(bag, "missing"), nil)) != 0 {
+		t.Error("create only")
+	}
+	r, _ = http.NewRequest("GET", "/tmp?apikey=test", nil)
+	r.Header.Set("If-None-Match", "W/"+etag)
+	if checkPreconditions(r, etag) != http.StatusNotModified {
+		t.Error("not modified")
+	}
+
+	unlock := lockBags(bag, "TESTCONDITIONALOTHER", bag)
+	unlock()
+	lockBags("TESTCONDITIONALOTHER", bag)()
+	forgetBagLock("TESTCONDITIONALOTHER")
+	deleteBagContent(bag, "")
+	if bagLocks[bag] != nil {
+		t.Error("lock of a deleted bag")
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	bag := "TESTSTORAGEUSAGEBAG"
+	MakeBagInternal(bag)
+	defer deleteBagContent(bag, "")
+	storageUsage()
+	created := storageUsages[bag]
+	p := GetBagPathInternal(bag)
+	_ = os.WriteFile(p, []byte("usage"), 0700)
+	storageUsage()
+	if created == 5 || storageUsages[bag] != created {
+		t.Error("usage was measured before the write finished")
+	}
+	updateBagDigest(bag, "", p, nil)
+	storageUsage()
+	if storageUsages[bag] != 5 {
+		t.Error(storageUsages[bag])
+	}
+	deleteBagContent(bag, "")
+	storageUsage()
+	if _, ok := storageUsages[bag]; ok {
+		t.Error("usage of a deleted bag")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	bag := "TESTBACKUPRESTOREBAG"
+	saved := bags
+	bags = map[string]string{}
+	defer func() { bags = saved }()
+	MakeBagInternal(bag)
+	defer deleteBagContent(bag, "")
+	_ = os.WriteFile(GetBagPathInternal(bag), []byte("content"), 0700)
+	p := GetBagObjectPathInternal(bag, "reports/q3.csv")
+	_ = os.MkdirAll(path.Dir(p), 0700)
+	_ = os.WriteFile(p, []byte("object"), 0700)
+	record := bags[bag]
+
+	backup := bytes.Buffer{}
+	w := bufio.NewWriter(&backup)
+	LogSnapshot("GET", w, nil)
+	_ = w.Flush()
+	deleteBagContent(bag, "")
+
+	LogSnapshot("PUT", nil, bufio.NewReader(&backup))
+	if bags[bag] != record {
+		t.Error("record was not restored", bags[bag])
+	}
+	if string(GetBagInternal(bag)) != "content" {
+		t.Error("content was not restored", string(GetBagInternal(bag)))
+	}
+	object, _ := os.ReadFile(p)
+	if string(object) != "object" {
+		t.Error("object was not restored", string(object))
+	}
+}
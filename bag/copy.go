@@ -0,0 +1,51 @@
+package bag
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+func copyBagFile(from string, fromKey []byte, to string, toKey []byte) error {
+	reader, err := openBagReader(from, fromKey)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	_ = os.MkdirAll(path.Dir(to), 0700)
+	writer, err := createBagWriter(to, toKey)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// copyBagInternal copies the content and the named objects of a bag to another local bag.
+func copyBagInternal(from string, fromKey []byte, to string, toKey []byte) error {
+	err := copyBagFile(GetBagPathInternal(from), fromKey, GetBagPathInternal(to), toKey)
+	if err != nil {
+		return err
+	}
+	updateBagDigest(to, "", GetBagPathInternal(to), toKey)
+	deleteBagObjects(to)
+	for _, name := range listBagObjects(from, "") {
+		err = copyBagFile(GetBagObjectPathInternal(from, name), fromKey, GetBagObjectPathInternal(to, name), toKey)
+		if err != nil {
+			return err
+		}
+		updateBagDigest(to, name, GetBagObjectPathInternal(to, name), toKey)
+	}
+	return nil
+}
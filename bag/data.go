@@ -3,7 +3,6 @@ package bag
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"gitlab.com/eper.io/engine/drawing"
 	"gitlab.com/eper.io/engine/englang"
 	"io"
@@ -21,23 +20,61 @@ import (
 
 var bags = map[string]string{}
 
+// Derived read only and write only keys of bags
+var shares = map[string]string{}
+
+// Redundant bags with their shards
+var raids = map[string]string{}
+
+// Chunked uploads in progress
+var uploads = map[string]string{}
+
 const ValidPeriod = 168 * time.Hour
 
+// Binaries of bags follow the records in backups.
+const binaryEntryPrefix = "Indexed entity "
+
+// Coin files are lists of voucher links. Anything larger is not a coin.
+const maxCoinSize = 1024 * 1024
+
 func LogSnapshot(m string, w *bufio.Writer, r *bufio.Reader) {
 	if m == "GET" {
 		for k, v := range bags {
 			englang.WriteIndexedEntry(w, k, "bag", bytes.NewBufferString(v))
 		}
+		for k, v := range shares {
+			englang.WriteIndexedEntry(w, k, "share", bytes.NewBufferString(v))
+		}
+		for k, v := range raids {
+			englang.WriteIndexedEntry(w, k, "raid", bytes.NewBufferString(v))
+		}
+		for k, v := range uploads {
+			englang.WriteIndexedEntry(w, k, "upload", bytes.NewBufferString(v))
+		}
 	}
 	if m == "PUT" {
 		for {
-			e, k, v := englang.ReadIndexedEntry(*r)
+			// Records end, where binaries start. The binary line is left for logBinaries.
+			next, _ := r.Peek(len(binaryEntryPrefix))
+			if string(next) == binaryEntryPrefix {
+				break
+			}
+			e, k, v := englang.ReadIndexedEntry(r)
 			if k == "" {
-				return
+				break
 			}
 			if e == "bag" {
 				bags[k] = v
 			}
+			if e == "share" {
+				shares[k] = v
+			}
+			if e == "raid" {
+				raids[k] = v
+			}
+			if e == "upload" {
+				uploads[k] = v
+			}
 		}
 	}
 	// Bags are special with binary data at the end to support debugging.
@@ -48,7 +85,7 @@ func logBinaries(m string, w *bufio.Writer, r *bufio.Reader) {
 	if m == "GET" {
 		for k, _ := range bags {
 			bag := k
-			filePath := path.Join(fmt.Sprintf("/tmp/%s", bag))
+			filePath := GetBagPathInternal(bag)
 			binaryData := drawing.NoErrorFile(os.Open(filePath))
 			var length int64
 			stat, _ := binaryData.Stat()
@@ -57,18 +94,39 @@ func logBinaries(m string, w *bufio.Writer, r *bufio.Reader) {
 			}
 			drawing.NoErrorWrite(w.WriteString(englang.Printf("Indexed entity %s of bytes %s follows.\n", k, englang.DecimalString(length))))
 			drawing.NoErrorWrite64(w.ReadFrom(binaryData))
+			for _, name := range listBagObjects(bag, "") {
+				objectData := drawing.NoErrorFile(os.Open(GetBagObjectPathInternal(bag, name)))
+				length = 0
+				stat, _ = objectData.Stat()
+				if stat != nil {
+					length = stat.Size()
+				}
+				drawing.NoErrorWrite(w.WriteString(englang.Printf("Indexed entity %s object %s of bytes %s follows.\n", k, name, englang.DecimalString(length))))
+				drawing.NoErrorWrite64(w.ReadFrom(objectData))
+			}
 		}
 	}
 	if m == "PUT" {
 		for {
 			line, _ := r.ReadBytes('\n')
-			var bag, lengths string
-			if nil == englang.Scanf1(string(line), "Indexed entity %s of bytes %s follows.\n", &bag, &lengths) {
+			var bag, name, lengths string
+			if nil == englang.Scanf1(string(line), "Indexed entity %s object %s of bytes %s follows.\n", &bag, &name, &lengths) {
+				length := englang.Decimal(lengths)
+				content := make([]byte, length)
+				n, _ := io.ReadFull(r, content)
+				filePath := GetBagObjectPathInternal(bag, name)
+				if filePath != "" {
+					_ = os.MkdirAll(path.Dir(filePath), 0700)
+					_ = os.WriteFile(filePath, content[0:n], 0700)
+				}
+				forgetStorageUsage(bag)
+			} else if nil == englang.Scanf1(string(line), "Indexed entity %s of bytes %s follows.\n", &bag, &lengths) {
 				length := englang.Decimal(lengths)
 				content := make([]byte, length)
 				n, _ := io.ReadFull(r, content)
-				filePath := path.Join(fmt.Sprintf("/tmp/%s", bag))
+				filePath := GetBagPathInternal(bag)
 				_ = os.WriteFile(filePath, content[0:n], 0700)
+				forgetStorageUsage(bag)
 			} else {
 				return
 			}
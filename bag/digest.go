@@ -0,0 +1,148 @@
+package bag
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Instrument data moves through bags hopping between nodes.
+// Each upload is checksummed, so that corruption is detected on the way.
+// The server stores the SHA-256 of the content in the bag record.
+// It is returned as a Digest: sha-256=... header and it is listed by TRACE.
+// Uploads can carry Digest: sha-256=... or Content-MD5 headers of the body.
+// Mismatching uploads are rejected before they touch the bag.
+// Appends and partial writes drop the checksum, so that they do not read the whole bag. It is computed again on the next read.
+// curl -X PUT -H "Digest: sha-256=$(openssl dgst -sha256 -binary data | base64)" --data-binary @data https://example.com/tmp?apikey=...
+
+func requestedDigests(r *http.Request) map[string]string {
+	ret := map[string]string{}
+	for _, digest := range strings.Split(r.Header.Get("Digest"), ",") {
+		pair := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(pair) == 2 {
+			ret[strings.ToLower(pair[0])] = pair[1]
+		}
+	}
+	contentMd5 := r.Header.Get("Content-MD5")
+	if contentMd5 != "" {
+		ret["md5"] = contentMd5
+	}
+	return ret
+}
+
+// verifiedBody returns the request body checked against the digest headers.
+func verifiedBody(r *http.Request, p string) (io.ReadCloser, error) {
+	expected := requestedDigests(r)
+	if expected["sha-256"] == "" && expected["md5"] == "" {
+		return r.Body, nil
+	}
+	spool, err := os.CreateTemp(path.Dir(p), "upload")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(spool.Name())
+	hashes := map[string]hash.Hash{"sha-256": sha256.New(), "md5": md5.New()}
+	_, err = io.Copy(io.MultiWriter(spool, hashes["sha-256"], hashes["md5"]), r.Body)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	for algorithm, h := range hashes {
+		if err == nil && expected[algorithm] != "" && expected[algorithm] != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+			err = fmt.Errorf("%s digest mismatch", algorithm)
+		}
+	}
+	if err != nil {
+		_ = spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+func fileDigest(p string, key []byte) ([]byte, error) {
+	f, err := openBagReader(p, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func digestRecordPrefix(name string) string {
+	if name == "" {
+		return "SHA-256 checksum of the content is "
+	}
+	return englang.Printf("SHA-256 checksum of object %s is ", name)
+}
+
+// updateBagDigest stores the checksum of the bag or a named object in the bag record.
+func updateBagDigest(bag string, name string, p string, key []byte) []byte {
+	sum, err := fileDigest(p, key)
+	line := ""
+	if err == nil {
+		line = digestRecordPrefix(name) + hex.EncodeToString(sum) + "."
+	}
+	setBagRecordLine(bag, digestRecordPrefix(name), line)
+	updateStorageUsage(bag)
+	return sum
+}
+
+// invalidateBagDigest drops the checksum of content changed in place.
+func invalidateBagDigest(bag string, name string) {
+	setBagRecordLine(bag, digestRecordPrefix(name), "")
+	updateStorageUsage(bag)
+}
+
+func getBagDigest(bag string, name string) string {
+	prefix := digestRecordPrefix(name)
+	for _, line := range strings.Split(bags[bag], "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSuffix(strings.TrimPrefix(line, prefix), ".")
+		}
+	}
+	return ""
+}
+
+// setBagRecordLine replaces the record line with a prefix. Empty lines remove it.
+func setBagRecordLine(bag string, prefix string, line string) {
+	record, ok := bags[bag]
+	if !ok {
+		return
+	}
+	bags[bag] = mesh.SetRecordLine(record, prefix, line)
+}
+
+func writeDigestHeader(w http.ResponseWriter, sum []byte) {
+	if sum != nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		w.Header().Set("ETag", "\""+hex.EncodeToString(sum)+"\"")
+	}
+}
+
+func writeRecordedDigestHeader(w http.ResponseWriter, bag string, name string) {
+	sum, err := hex.DecodeString(getBagDigest(bag, name))
+	if err == nil && len(sum) > 0 {
+		writeDigestHeader(w, sum)
+	}
+}
@@ -0,0 +1,352 @@
+package bag
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net/http"
+	"os"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags can be encrypted at rest. This is chosen, when the bag is bought.
+// curl -X PUT --data-binary @coin 'https://example.com/tmp.coin?encrypt=1'
+// The key is derived from the bag apikey, and it is never stored.
+// The apikey of an encrypted bag is a new random key, not the voucher that paid for it.
+// The record, the file, the mesh index and the expiry of the bag use a fingerprint of the apikey.
+// A stolen disk or a /logs.md backup file contains the ciphertext and the fingerprint only.
+// GET /tmp returns plaintext to anyone who knows the apikey like before.
+// Files are chunks of 64 KiB sealed by AES-256 GCM, so that ranged reads and partial writes work.
+// Each chunk is stored as a random nonce followed by the ciphertext and the tag.
+// A changed chunk is sealed again with a new nonce, and modified chunks fail to read.
+
+const encryptedMarker = "Content is encrypted at rest."
+
+func bagFingerprint(bag string) string {
+	sum := sha256.Sum256([]byte("Bag fingerprint of " + bag))
+	return hex.EncodeToString(sum[:])
+}
+
+func bagCipherKey(bag string) []byte {
+	sum := sha256.Sum256([]byte("Bag content key of " + bag))
+	return sum[:]
+}
+
+// resolveBag returns the storage key of the bag record and the content key, if any.
+func resolveBag(bag string) (string, []byte) {
+	if bags[bag] != "" {
+		return bag, nil
+	}
+	fingerprint := bagFingerprint(bag)
+	if bags[fingerprint] != "" {
+		return fingerprint, bagCipherKey(bag)
+	}
+	return bag, nil
+}
+
+func MakeEncryptedBagInternal(bag string) string {
+	fingerprint := bagFingerprint(bag)
+	bags[fingerprint] = "Bag is valid.\n" + encryptedMarker
+	setBagQuota(fingerprint, 1)
+	mesh.RegisterIndex(fingerprint)
+	mesh.SetExpiry(fingerprint, ValidPeriod)
+	path1 := GetBagPathInternal(fingerprint)
+	bagFile, err := createBagWriter(path1, bagCipherKey(bag))
+	if err == nil {
+		w := bufio.NewWriter(bagFile)
+		_, _ = w.WriteString(fmt.Sprintf("curl -X GET %s/tmp?apikey=%s", metadata.SiteUrl, bag))
+		_ = w.Flush()
+		_ = bagFile.Close()
+	}
+	updateBagDigest(fingerprint, "", path1, bagCipherKey(bag))
+	return bag
+}
+
+// indexKey is the key of an apikey in the mesh index and expiry.
+func indexKey(apiKey string) string {
+	fingerprint := bagFingerprint(apiKey)
+	if bags[fingerprint] != "" || shares[fingerprint] != "" {
+		return fingerprint
+	}
+	return apiKey
+}
+
+// redirectToBagServer forwards the request to the node of the bag, even if only the fingerprint is indexed.
+func redirectToBagServer(w http.ResponseWriter, r *http.Request) error {
+	if nil == mesh.RedirectToPeerServer(w, r) {
+		return nil
+	}
+	apiKey := r.URL.Query().Get("apikey")
+	if apiKey == "" {
+		return fmt.Errorf("not found")
+	}
+	return mesh.RedirectToPeerServerByKey(w, r, bagFingerprint(apiKey))
+}
+
+// encryptedChunk is the plaintext size of a chunk. Each chunk is stored with its nonce and its tag.
+const encryptedChunk = 64 * 1024
+
+var errModifiedContent = errors.New("encrypted bag content was modified")
+
+// encryptedFile keeps the chunk being read or written in plaintext, and it seals it again, when it moves on.
+type encryptedFile struct {
+	file   *os.File
+	aead   cipher.AEAD
+	size   int64
+	offset int64
+	chunk  int64
+	plain  []byte
+	dirty  bool
+}
+
+func (e *encryptedFile) sealedChunk() int64 {
+	return int64(encryptedChunk + e.aead.NonceSize() + e.aead.Overhead())
+}
+
+// chunkData authenticates the position of the chunk, so that chunks cannot be swapped.
+func chunkData(chunk int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(chunk))
+	return data
+}
+
+func (e *encryptedFile) load(chunk int64) error {
+	if chunk == e.chunk {
+		return nil
+	}
+	err := e.flush()
+	if err != nil {
+		return err
+	}
+	e.chunk, e.plain = chunk, e.plain[:0]
+	length := e.size - chunk*encryptedChunk
+	if length <= 0 {
+		return nil
+	}
+	if length > encryptedChunk {
+		length = encryptedChunk
+	}
+	sealed := make([]byte, length+int64(e.aead.NonceSize()+e.aead.Overhead()))
+	_, err = e.file.ReadAt(sealed, chunk*e.sealedChunk())
+	if err != nil {
+		e.chunk = -1
+		return err
+	}
+	nonce := sealed[:e.aead.NonceSize()]
+	e.plain, err = e.aead.Open(e.plain, nonce, sealed[len(nonce):], chunkData(chunk))
+	if err != nil {
+		e.chunk = -1
+		return errModifiedContent
+	}
+	return nil
+}
+
+// flush seals the changed chunk with a fresh nonce, so that no keystream is ever used twice.
+func (e *encryptedFile) flush() error {
+	if !e.dirty {
+		return nil
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	_, err = e.file.WriteAt(e.aead.Seal(nonce, nonce, e.plain, chunkData(e.chunk)), e.chunk*e.sealedChunk())
+	if err != nil {
+		return err
+	}
+	e.dirty = false
+	return nil
+}
+
+func (e *encryptedFile) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && e.offset < e.size {
+		chunk := e.offset / encryptedChunk
+		err := e.load(chunk)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], e.plain[e.offset-chunk*encryptedChunk:])
+		n += copied
+		e.offset += int64(copied)
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (e *encryptedFile) Write(p []byte) (int, error) {
+	if e.offset > e.size {
+		return 0, fmt.Errorf("offset beyond the end of the bag")
+	}
+	n := 0
+	for n < len(p) {
+		chunk := e.offset / encryptedChunk
+		err := e.load(chunk)
+		if err != nil {
+			return n, err
+		}
+		start := int(e.offset - chunk*encryptedChunk)
+		end := start + len(p) - n
+		if end > encryptedChunk {
+			end = encryptedChunk
+		}
+		if end > len(e.plain) {
+			e.plain = append(e.plain, make([]byte, end-len(e.plain))...)
+		}
+		copied := copy(e.plain[start:end], p[n:])
+		e.dirty = true
+		n += copied
+		e.offset += int64(copied)
+		if e.offset > e.size {
+			e.size = e.offset
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset = e.offset + offset
+	case io.SeekEnd:
+		offset = e.size + offset
+	}
+	if offset < 0 {
+		return e.offset, fmt.Errorf("negative offset")
+	}
+	e.offset = offset
+	return e.offset, nil
+}
+
+func (e *encryptedFile) Close() error {
+	err := e.flush()
+	closeErr := e.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func openEncryptedFile(f *os.File, key []byte) (*encryptedFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	e := &encryptedFile{file: f, aead: aead, chunk: -1}
+	overhead := e.sealedChunk() - encryptedChunk
+	last := stat.Size() % e.sealedChunk()
+	if last != 0 && last <= overhead {
+		_ = f.Close()
+		return nil, errModifiedContent
+	}
+	e.size = stat.Size() / e.sealedChunk() * encryptedChunk
+	if last != 0 {
+		e.size += last - overhead
+	}
+	return e, nil
+}
+
+// openBagReader returns the plaintext of a bag file.
+func openBagReader(p string, key []byte) (io.ReadSeekCloser, error) {
+	f, err := os.Open(p)
+	if err != nil || key == nil {
+		return f, err
+	}
+	return openEncryptedFile(f, key)
+}
+
+// createBagWriter truncates a bag file for a new content.
+func createBagWriter(p string, key []byte) (io.WriteCloser, error) {
+	f, err := os.Create(p)
+	if err != nil || key == nil {
+		return f, err
+	}
+	return openEncryptedFile(f, key)
+}
+
+// openBagWriterAt continues writing a bag file at a plaintext offset or at the end, if it is negative.
+func openBagWriterAt(p string, key []byte, offset int64) (io.WriteCloser, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+	var file io.WriteSeeker = f
+	var closer io.WriteCloser = f
+	if key != nil {
+		encrypted, err := openEncryptedFile(f, key)
+		if err != nil {
+			return nil, err
+		}
+		file = encrypted
+		closer = encrypted
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil && offset > size {
+		err = fmt.Errorf("offset beyond the end of the bag")
+	}
+	if err == nil && offset >= 0 {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = closer.Close()
+		return nil, err
+	}
+	return closer, nil
+}
+
+func bagSize(p string, key []byte) int64 {
+	f, err := openBagReader(p, key)
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = f.Close() }()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func serveEncryptedFile(w http.ResponseWriter, r *http.Request, p string, key []byte) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f, err := openBagReader(p, key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
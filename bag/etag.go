@@ -0,0 +1,129 @@
+package bag
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags have strong ETags, the SHA-256 checksum of the content.
+// Collaborating clients can use optimistic concurrency on a shared bag.
+// curl -X GET -i 'https://example.com/tmp?apikey=<bag>' returns ETag: "<checksum>".
+// curl -X PUT -H 'If-Match: "<checksum>"' --data-binary @review.txt 'https://example.com/tmp?apikey=<bag>'
+// The write fails with 412 Precondition Failed, if somebody else changed the bag in the meantime.
+// If-None-Match: * creates a named object only, if it does not exist yet.
+// Writes of a bag are serialized, so that the check and the write happen together.
+// Copies and moves hold the lock of the destination bag as well.
+
+var bagLocks = map[string]*sync.Mutex{}
+var bagLocksLock = sync.Mutex{}
+
+func lockBag(bag string) func() {
+	bagLocksLock.Lock()
+	lock, ok := bagLocks[bag]
+	if !ok {
+		lock = &sync.Mutex{}
+		bagLocks[bag] = lock
+	}
+	bagLocksLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// lockBags locks several bags in a fixed order, so that transfers in opposite directions do not wait for each other.
+func lockBags(bags ...string) func() {
+	sorted := make([]string, 0)
+	for _, bag := range bags {
+		if bag != "" && !containsBag(sorted, bag) {
+			sorted = append(sorted, bag)
+		}
+	}
+	sort.Strings(sorted)
+	unlocks := make([]func(), 0)
+	for _, bag := range sorted {
+		unlocks = append(unlocks, lockBag(bag))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+func containsBag(list []string, bag string) bool {
+	for _, b := range list {
+		if b == bag {
+			return true
+		}
+	}
+	return false
+}
+
+func forgetBagLock(bag string) {
+	bagLocksLock.Lock()
+	delete(bagLocks, bag)
+	bagLocksLock.Unlock()
+}
+
+// bagETag returns the quoted checksum of the content, or an empty string, if it does not exist.
+func bagETag(bag string, name string, p string, key []byte) string {
+	_, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	digest := getBagDigest(bag, name)
+	if digest == "" {
+		digest = hex.EncodeToString(updateBagDigest(bag, name, p, key))
+	}
+	if digest == "" {
+		return ""
+	}
+	return "\"" + digest + "\""
+}
+
+func matchesETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" && etag != "" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPreconditions tells, whether the ETag is needed. Appends without conditions do not read the bag.
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPreconditions returns the status to reply with, or zero, if the request can go on.
+func checkPreconditions(r *http.Request, etag string) int {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !matchesETag(ifMatch, etag, false) {
+		return http.StatusPreconditionFailed
+	}
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && matchesETag(ifNoneMatch, etag, true) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/englang"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// A bag can hold a small tree of named objects next to its main file.
+// One voucher buys a whole dataset of small files this way.
+// curl -X PUT --data-binary @q3.csv 'https://example.com/tmp?apikey=...&name=reports/q3.csv'
+// curl -X GET 'https://example.com/tmp?apikey=...&name=reports/q3.csv'
+// curl -X DELETE 'https://example.com/tmp?apikey=...&name=reports/q3.csv'
+// curl -X GET 'https://example.com/tmp?apikey=...&name=reports/' lists the objects with a prefix.
+// Names are cleaned, they cannot point outside the bag.
+
+func getBagObjectsPathInternal(bag string) string {
+	return GetBagPathInternal(bag) + ".objects"
+}
+
+func GetBagObjectPathInternal(bag string, name string) string {
+	if name == "" || strings.ContainsAny(name, "\r\n") {
+		return ""
+	}
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return ""
+	}
+	return path.Join(getBagObjectsPathInternal(bag), cleaned)
+}
+
+func isBagObjectListing(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
+
+func listBagObjects(bag string, prefix string) []string {
+	root := getBagObjectsPathInternal(bag)
+	prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+	ret := make([]string, 0)
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(p, root+string(filepath.Separator)))
+		if strings.HasPrefix(name, prefix) {
+			ret = append(ret, name)
+		}
+		return nil
+	})
+	sort.Strings(ret)
+	return ret
+}
+
+func writeBagObjectList(w io.Writer, bag string, key []byte, prefix string) {
+	for _, name := range listBagObjects(bag, prefix) {
+		size := bagSize(GetBagObjectPathInternal(bag, name), key)
+		_, _ = io.WriteString(w, englang.Printf("Object %s has %s bytes.\n", name, englang.DecimalString(size)))
+	}
+}
+
+func deleteBagObjects(bag string) {
+	_ = os.RemoveAll(getBagObjectsPathInternal(bag))
+}
@@ -0,0 +1,61 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"net/http"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bag owners can be warned before their bags expire, and when they are deleted.
+// curl -X PUT -d 'https://example.com/hook' 'https://example.com/tmp.notify?apikey=<bag>&hours=48'
+// curl -X PUT -d 'ops@example.com' 'https://example.com/tmp.notify?apikey=<bag>'
+// curl -X GET 'https://example.com/tmp.notify?apikey=<bag>'
+// curl -X DELETE 'https://example.com/tmp.notify?apikey=<bag>'
+// The warning is sent once, and it is sent again after a renewal.
+
+func setupNotifications() {
+	http.HandleFunc("/tmp.notify", func(w http.ResponseWriter, r *http.Request) {
+		if nil == redirectToBagServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		bag, _ := resolveBag(apiKey)
+		if bags[bag] == "" || !mesh.CheckExpiry(bag) {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mesh.ServeNotification(w, r, bags[bag], ValidPeriod, func(prefix string, line string) {
+			setBagRecordLine(bag, prefix, line)
+		})
+	})
+}
+
+// WarnExpiringBag notifies the owner once, if the bag expires within the requested period.
+func WarnExpiringBag(bag string) {
+	target, expires, due := mesh.ExpiryWarningDue(bag, bags[bag])
+	if !due {
+		return
+	}
+	setBagRecordLine(bag, mesh.ExpiryWarningSent, mesh.ExpiryWarningSent)
+	mesh.NotifyOwner(target, englang.Printf("Bag %s expires on %s. Renew it with a PUT to %s/tmp.renew.", drawing.RedactPublicKey(bag), expires.Format("Jan 2, 2006"), metadata.SiteUrl))
+}
+
+func notifyDeletedBag(bag string, record string) {
+	target, _, _ := mesh.GetNotification(record)
+	if target == "" {
+		return
+	}
+	mesh.NotifyOwner(target, englang.Printf("Bag %s expired and it was deleted on %s.", drawing.RedactPublicKey(bag), time.Now().Format("Jan 2, 2006")))
+}
@@ -0,0 +1,122 @@
+package bag
+
+import (
+	"bufio"
+	"bytes"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// The bag form shows a preview of the content, so that it does not need to be downloaded.
+// Text files show their first lines, tarballs list their members, and images get a thumbnail.
+// Size, checksum and expiry are shown for all bags.
+// Bags larger than 64 MiB show the summary only, and tarballs list their first members, so that previews are cheap.
+
+const previewLines = 12
+const previewLineLength = 80
+const maxThumbnailPixels = 4096 * 4096
+
+var maxPreviewSize int64 = 64 * 1024 * 1024
+
+// previewBag returns the summary, the first lines or members, and a thumbnail, if the content is an image.
+func previewBag(apiKey string) (string, string, image.Image) {
+	bag, key := resolveBag(apiKey)
+	if bags[bag] == "" {
+		return "", "", nil
+	}
+	p := GetBagPathInternal(bag)
+	size := bagSize(p, key)
+	summary := []string{
+		englang.Printf("The bag has %s bytes and %s named objects.", englang.DecimalString(size), englang.DecimalString(int64(len(listBagObjects(bag, ""))))),
+		englang.Printf("SHA-256 %s", getBagDigest(bag, "")),
+	}
+	expires, err := mesh.GetExpiry(bag)
+	if err == nil {
+		summary = append(summary, englang.Printf("It is valid until %s.", expires.Format("Jan 2, 2006")))
+	}
+
+	if size > maxPreviewSize {
+		summary = append(summary, "It is too large for a preview.")
+		return strings.Join(summary, "\n"), "", nil
+	}
+
+	members := bytes.Buffer{}
+	if listTarballMembers(&members, p, key, previewLines) == nil && members.Len() > 0 {
+		summary = append(summary, "It is a tarball.")
+		return strings.Join(summary, "\n"), firstLines(&members), nil
+	}
+
+	reader, err := openBagReader(p, key)
+	if err != nil {
+		return strings.Join(summary, "\n"), "", nil
+	}
+	defer func() { _ = reader.Close() }()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(reader, head)
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	summary = append(summary, englang.Printf("Content type is %s.", contentType))
+	if strings.HasPrefix(contentType, "image/") {
+		_, _ = reader.Seek(0, io.SeekStart)
+		config, _, err := image.DecodeConfig(reader)
+		if err == nil && config.Width*config.Height <= maxThumbnailPixels {
+			_, _ = reader.Seek(0, io.SeekStart)
+			img, _, err := image.Decode(reader)
+			if err == nil {
+				return strings.Join(summary, "\n"), englang.Printf("Image of %s by %s pixels.", englang.DecimalString(int64(config.Width)), englang.DecimalString(int64(config.Height))), img
+			}
+		}
+		return strings.Join(summary, "\n"), "", nil
+	}
+	if strings.HasPrefix(contentType, "text/") || utf8.Valid(head) {
+		return strings.Join(summary, "\n"), firstLines(bytes.NewBuffer(head)), nil
+	}
+	return strings.Join(summary, "\n"), "", nil
+}
+
+func firstLines(r io.Reader) string {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() && len(lines) < previewLines {
+		line := strings.ReplaceAll(scanner.Text(), "\t", "    ")
+		if utf8.RuneCountInString(line) > previewLineLength {
+			line = string([]rune(line)[:previewLineLength]) + "..."
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// thumbnail fits an image into a box keeping its aspect ratio.
+func thumbnail(img image.Image, box image.Rectangle) image.Image {
+	canvas := image.NewRGBA64(image.Rectangle{Max: image.Point{X: box.Dx(), Y: box.Dy()}})
+	drawing.FillWithColor(drawing.ImageSlice{Rgb: canvas, Rect: canvas.Bounds()}, drawing.White)
+	if img.Bounds().Empty() {
+		return canvas
+	}
+	width, height := box.Dx(), img.Bounds().Dy()*box.Dx()/img.Bounds().Dx()
+	if height > box.Dy() {
+		width, height = img.Bounds().Dx()*box.Dy()/img.Bounds().Dy(), box.Dy()
+	}
+	fit := image.Rectangle{Max: image.Point{X: width, Y: height}}.Add(image.Point{X: (box.Dx() - width) / 2, Y: (box.Dy() - height) / 2})
+	if !fit.Empty() {
+		drawing.DrawImage(drawing.ImageSlice{Rgb: canvas, Rect: fit}, img)
+	}
+	return canvas
+}
@@ -0,0 +1,106 @@
+package bag
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// A voucher buys a bag of metadata.BagQuota bytes including its named objects.
+// Larger tiers consume more vouchers from the same invoice or coin file.
+// curl -X PUT --data-binary @coin 'https://example.com/tmp.coin?units=4'
+// Uploads that would grow the bag beyond its quota are rejected with 413.
+// Without a Content-Length the upload stops at the quota, and it is rejected.
+
+func setBagQuota(bag string, units int64) {
+	quota := units * metadata.BagQuota
+	setBagRecordLine(bag, "Bag quota is ", englang.Printf("Bag quota is %s bytes.", englang.DecimalString(quota)))
+}
+
+func getBagQuota(bag string) int64 {
+	for _, line := range strings.Split(bags[bag], "\n") {
+		var quota string
+		if nil == englang.Scanf1(line, "Bag quota is %s bytes.", &quota) {
+			return englang.Decimal(quota)
+		}
+	}
+	// Bags restored from older backups
+	return metadata.BagQuota
+}
+
+func requestedUnits(r *http.Request) int64 {
+	units := englang.Decimal(r.URL.Query().Get("units"))
+	if units < 1 {
+		return 1
+	}
+	return units
+}
+
+func bagUsage(bag string) int64 {
+	used := int64(0)
+	stat, err := os.Stat(GetBagPathInternal(bag))
+	if err == nil {
+		used = used + stat.Size()
+	}
+	for _, name := range listBagObjects(bag, "") {
+		stat, err = os.Stat(GetBagObjectPathInternal(bag, name))
+		if err == nil {
+			used = used + stat.Size()
+		}
+	}
+	return used
+}
+
+// uploadAllowance returns the bytes the request body can add to the bag.
+func uploadAllowance(bag string, r *http.Request, p string) int64 {
+	replaced := int64(0)
+	stat, err := os.Stat(p)
+	if err == nil {
+		replaced = stat.Size()
+	}
+	offset, _, partial, _ := requestedOffset(r)
+	if partial && offset < replaced {
+		replaced = replaced - offset
+	} else if partial || r.Method == "PATCH" || r.URL.Query().Get("append") != "" {
+		replaced = 0
+	}
+	return getBagQuota(bag) - bagUsage(bag) + replaced
+}
+
+type quotaReader struct {
+	reader   io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.left <= 0 {
+		n, _ := q.reader.Read(p[0:1])
+		if n > 0 {
+			q.exceeded = true
+			return 0, fmt.Errorf("quota exceeded")
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > q.left {
+		p = p[0:q.left]
+	}
+	n, err := q.reader.Read(p)
+	q.left -= int64(n)
+	return n, err
+}
+
+func (q *quotaReader) Close() error {
+	return nil
+}
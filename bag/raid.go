@@ -0,0 +1,540 @@
+package bag
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Redundant bags are made of several shard bags placed on different nodes of the mesh.
+// One coin buys all the shards.
+// curl -X PUT --data-binary @coin 'https://example.com/tmp.coin?apikey=<invoice>&shards=3&mode=mirror'
+// curl -X PUT --data-binary @file 'https://example.com/tmp.raid?apikey=<redundant bag>'
+// curl -X GET 'https://example.com/tmp.raid?apikey=<redundant bag>'
+// curl -X TRACE 'https://example.com/tmp.raid?apikey=<redundant bag>'
+// curl -X DELETE 'https://example.com/tmp.raid?apikey=<redundant bag>'
+// Mirrors are like RAID 1. They can be read, while any of the shards is available.
+// Parity is like RAID 5. The content is striped into shards-1 pieces and an xor parity shard.
+// Any one shard can be lost, and the content is reconstructed on read.
+// There is a single parity shard only. Parity bags losing two shards lose their content, so use mirrors for more copies.
+// Shards that missed a write are marked out of date and they are not read until the next successful write.
+// Each shard has the quota bought, so mirrors hold up to the quota, and parity bags hold the quota times shards-1.
+// Each shard is on a different node. The vouchers are refunded, if there are not enough nodes with space, or the shards cannot be created.
+
+const raidMirror = "mirror"
+const raidParity = "parity"
+const maxRaidShards = 16
+
+type raidShard struct {
+	index int
+	bag   string
+	node  string
+}
+
+func setupRaid() {
+	http.HandleFunc("/tmp.shard", func(w http.ResponseWriter, r *http.Request) {
+		// Nodes create shards for each other without a coin.
+		if r.Method != "PUT" || r.URL.Query().Get("apikey") != metadata.ActivationKey {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !hasStorageForNewBag() {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		shard := MakeBagInternal(drawing.GenerateUniqueKey())
+		setBagQuota(shard, requestedUnits(r))
+		_, _ = w.Write([]byte(shard))
+	})
+
+	http.HandleFunc("/tmp.raid", func(w http.ResponseWriter, r *http.Request) {
+		if nil == mesh.RedirectToPeerServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		if raids[apiKey] == "" || !mesh.CheckExpiry(apiKey) {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "PUT" {
+			w.WriteHeader(writeRaidInternal(apiKey, r.Body, r.ContentLength))
+			return
+		}
+		if r.Method == "GET" {
+			reader, err := openRaidInternal(apiKey)
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			defer func() { _ = reader.Close() }()
+			_, _ = io.Copy(w, reader)
+			return
+		}
+		if r.Method == "TRACE" {
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(describeRaid(apiKey)))
+			return
+		}
+		if r.Method == "DELETE" {
+			deleteRaidInternal(apiKey)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+func requestedRaid(r *http.Request) (string, int) {
+	count := int(englang.Decimal(r.URL.Query().Get("shards")))
+	if count == 0 {
+		return "", 0
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = raidMirror
+	}
+	return mode, count
+}
+
+func isValidRaid(mode string, count int) bool {
+	if count > maxRaidShards {
+		return false
+	}
+	return (mode == raidMirror && count >= 2) || (mode == raidParity && count >= 3)
+}
+
+// makeRaidInternal places shards on distinct nodes, and it registers the redundant bag on this one.
+// Shards already created are deleted, if any of them fails.
+func makeRaidInternal(raid string, mode string, count int, units int64) error {
+	nodes := mesh.FindNodesWithStorage(metadata.StorageReserve, count)
+	if len(nodes) < count {
+		return fmt.Errorf("%d nodes have space for %d shards", len(nodes), count)
+	}
+	record := []string{englang.Printf("Redundant bag of %s shards with %s.", englang.DecimalString(int64(count)), mode),
+		englang.Printf("Each shard has a quota of %s bytes.", englang.DecimalString(units*metadata.BagQuota))}
+	created := make([]raidShard, 0)
+	for i, node := range nodes {
+		shard, err := createShard(node, units)
+		if err != nil {
+			for _, shard := range created {
+				deleteShard(shard)
+			}
+			return err
+		}
+		created = append(created, raidShard{index: i, bag: shard, node: node})
+		record = append(record, englang.Printf("Shard %s on node %s is bag %s.", englang.DecimalString(int64(i)), node, shard))
+	}
+	raids[raid] = strings.Join(record, "\n")
+	mesh.RegisterIndex(raid)
+	mesh.SetExpiry(raid, ValidPeriod)
+	return nil
+}
+
+func createShard(node string, units int64) (string, error) {
+	if node == mesh.WhoAmI {
+		shard := MakeBagInternal(drawing.GenerateUniqueKey())
+		setBagQuota(shard, units)
+		return shard, nil
+	}
+	shard, err := management.HttpProxyRequest(englang.Printf("%s/tmp.shard?apikey=%s&units=%s", node, metadata.ActivationKey, englang.DecimalString(units)), "PUT", nil)
+	if err != nil {
+		return "", err
+	}
+	return string(shard), nil
+}
+
+// raidCapacity is the largest content the shards can hold.
+func raidCapacity(raid string) int64 {
+	mode, shards, _ := getRaid(raid)
+	quota := metadata.BagQuota
+	for _, line := range strings.Split(raids[raid], "\n") {
+		var bytes string
+		if nil == englang.Scanf1(line, "Each shard has a quota of %s bytes.", &bytes) {
+			quota = englang.Decimal(bytes)
+		}
+	}
+	if mode == raidParity {
+		return quota * int64(len(shards)-1)
+	}
+	return quota
+}
+
+func getRaid(raid string) (string, []raidShard, int64) {
+	mode := ""
+	shards := make([]raidShard, 0)
+	size := int64(0)
+	for _, line := range strings.Split(raids[raid], "\n") {
+		var count, m, index, shard, node, bytes string
+		if nil == englang.Scanf1(line, "Redundant bag of %s shards with %s.", &count, &m) {
+			mode = m
+		}
+		if nil == englang.Scanf1(line, "Shard %s on node %s is bag %s.", &index, &node, &shard) {
+			shards = append(shards, raidShard{index: int(englang.Decimal(index)), bag: shard, node: node})
+		}
+		if nil == englang.Scanf1(line, "Content has %s bytes.", &bytes) {
+			size = englang.Decimal(bytes)
+		}
+	}
+	return mode, shards, size
+}
+
+func setRaidRecordLine(raid string, prefix string, line string) {
+	raids[raid] = mesh.SetRecordLine(raids[raid], prefix, line)
+}
+
+func outOfDateLine(shard raidShard) string {
+	return englang.Printf("Shard %s is out of date.", englang.DecimalString(int64(shard.index)))
+}
+
+func isShardLocal(shard raidShard) bool {
+	return shard.node == mesh.WhoAmI && bags[shard.bag] != ""
+}
+
+func writeShard(shard raidShard, content io.Reader) error {
+	if isShardLocal(shard) {
+		unlock := lockBag(shard.bag)
+		defer unlock()
+		p := GetBagPathInternal(shard.bag)
+		limited := &quotaReader{reader: content, left: getBagQuota(shard.bag) - bagUsage(shard.bag) + bagSize(p, nil)}
+		err := replaceBagFile(shard.bag, "", p, nil, limited)
+		updateBagDigest(shard.bag, "", p, nil)
+		return err
+	}
+	reply, err := mesh.OpenPeerRequest(englang.Printf("%s/tmp?apikey=%s", shard.node, shard.bag), "PUT", content)
+	if err != nil {
+		return err
+	}
+	return reply.Close()
+}
+
+func readShard(shard raidShard) (io.ReadCloser, error) {
+	if isShardLocal(shard) {
+		return openBagReader(GetBagPathInternal(shard.bag), nil)
+	}
+	return mesh.OpenPeerRequest(englang.Printf("%s/tmp?apikey=%s", shard.node, shard.bag), "GET", nil)
+}
+
+func deleteShard(shard raidShard) {
+	if isShardLocal(shard) {
+		deleteBagContent(shard.bag, "")
+		mesh.DeleteIndex(shard.bag)
+		return
+	}
+	reply, err := mesh.OpenPeerRequest(englang.Printf("%s/tmp?apikey=%s", shard.node, shard.bag), "DELETE", nil)
+	if err == nil {
+		_ = reply.Close()
+	}
+}
+
+// raidTemp is an unlinked temporary file.
+func raidTemp() (*os.File, error) {
+	spool, err := os.CreateTemp(metadata.StorageRoot, "raid")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(spool.Name())
+	return spool, nil
+}
+
+// raidSpool copies the content into a temporary file. Content is limited by the caller.
+func raidSpool(content io.Reader) (*os.File, int64, error) {
+	spool, err := raidTemp()
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(spool, content)
+	if err != nil {
+		_ = spool.Close()
+		return nil, 0, err
+	}
+	return spool, size, nil
+}
+
+// spoolReader reads a spool from the beginning independently of other readers.
+func spoolReader(spool *os.File) io.Reader {
+	stat, err := spool.Stat()
+	if err != nil {
+		return &io.LimitedReader{}
+	}
+	return io.NewSectionReader(spool, 0, stat.Size())
+}
+
+// parityPieces splits content into equal sized pieces padded with zeros.
+func parityPieces(content io.ReaderAt, size int64, pieces int) []io.Reader {
+	length := (size + int64(pieces) - 1) / int64(pieces)
+	ret := make([]io.Reader, pieces)
+	for i := range ret {
+		start := int64(i) * length
+		available := size - start
+		if available < 0 {
+			available = 0
+		}
+		if available > length {
+			available = length
+		}
+		ret[i] = io.MultiReader(io.NewSectionReader(content, start, available), io.LimitReader(zeros{}, length-available))
+	}
+	return ret
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// xorPieces writes the xor of equal sized pieces.
+func xorPieces(w io.Writer, pieces []io.Reader) error {
+	sum := make([]byte, 64*1024)
+	buf := make([]byte, len(sum))
+	for {
+		n := -1
+		for i, piece := range pieces {
+			m, err := io.ReadFull(piece, buf)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			if i == 0 {
+				n = m
+				copy(sum, buf[:m])
+				continue
+			}
+			if m != n {
+				return fmt.Errorf("shard size mismatch")
+			}
+			for j := 0; j < m; j++ {
+				sum[j] ^= buf[j]
+			}
+		}
+		if n <= 0 {
+			return nil
+		}
+		_, err := w.Write(sum[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeRaidInternal spools the content of a known or unknown (-1) length, and it writes all the shards.
+func writeRaidInternal(raid string, content io.Reader, length int64) int {
+	mode, shards, _ := getRaid(raid)
+	capacity := raidCapacity(raid)
+	if length > capacity {
+		return http.StatusRequestEntityTooLarge
+	}
+	if length < 0 {
+		length = capacity
+	}
+	if !hasStorageForUpload(length) {
+		return http.StatusInsufficientStorage
+	}
+	limited := &quotaReader{reader: content, left: capacity}
+	spool, size, err := raidSpool(limited)
+	if limited.exceeded {
+		return http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	defer func() { _ = spool.Close() }()
+
+	var sources []io.Reader
+	if mode == raidParity {
+		parity, err := raidTemp()
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		defer func() { _ = parity.Close() }()
+		if xorPieces(parity, parityPieces(spool, size, len(shards)-1)) != nil {
+			return http.StatusInternalServerError
+		}
+		sources = append(parityPieces(spool, size, len(shards)-1), spoolReader(parity))
+	} else {
+		for range shards {
+			sources = append(sources, io.NewSectionReader(spool, 0, size))
+		}
+	}
+
+	failed := make([]bool, len(shards))
+	wg := sync.WaitGroup{}
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard raidShard) {
+			defer wg.Done()
+			failed[i] = writeShard(shard, sources[i]) != nil
+		}(i, shard)
+	}
+	wg.Wait()
+
+	written := 0
+	for i, shard := range shards {
+		if failed[i] {
+			setRaidRecordLine(raid, outOfDateLine(shard), outOfDateLine(shard))
+		} else {
+			setRaidRecordLine(raid, outOfDateLine(shard), "")
+			written++
+		}
+	}
+	setRaidRecordLine(raid, "Content has ", englang.Printf("Content has %s bytes.", englang.DecimalString(size)))
+	if written == 0 || (mode == raidParity && written < len(shards)-1) {
+		return http.StatusBadGateway
+	}
+	return http.StatusOK
+}
+
+func readRaidInternal(raid string, w io.Writer) error {
+	reader, err := openRaidInternal(raid)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// raidReader reads the content from spooled shards.
+type raidReader struct {
+	io.Reader
+	spools []*os.File
+}
+
+func (r *raidReader) Close() error {
+	for _, spool := range r.spools {
+		if spool != nil {
+			_ = spool.Close()
+		}
+	}
+	return nil
+}
+
+// openRaidInternal finds the shards to read before any of the content is returned, so that missing shards can be reported.
+func openRaidInternal(raid string) (io.ReadCloser, error) {
+	mode, shards, size := getRaid(raid)
+	if mode == raidMirror {
+		for _, shard := range shards {
+			if strings.Contains(raids[raid], outOfDateLine(shard)) {
+				continue
+			}
+			reader, err := readShard(shard)
+			if err == nil {
+				return reader, nil
+			}
+		}
+		return nil, fmt.Errorf("no shards")
+	}
+
+	spools := make([]*os.File, len(shards))
+	wg := sync.WaitGroup{}
+	for i, shard := range shards {
+		if strings.Contains(raids[raid], outOfDateLine(shard)) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shard raidShard) {
+			defer wg.Done()
+			reader, err := readShard(shard)
+			if err != nil {
+				return
+			}
+			defer func() { _ = reader.Close() }()
+			spool, _, err := raidSpool(reader)
+			if err == nil {
+				spools[i] = spool
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+	ret := &raidReader{spools: spools}
+
+	missing := -1
+	for i, spool := range spools {
+		if spool == nil {
+			if missing != -1 {
+				_ = ret.Close()
+				return nil, fmt.Errorf("too many shards are missing")
+			}
+			missing = i
+		}
+	}
+	if missing != -1 && missing < len(shards)-1 {
+		// Any shard is the xor of all the others.
+		others := make([]io.Reader, 0)
+		for i, spool := range spools {
+			if i != missing {
+				others = append(others, spoolReader(spool))
+			}
+		}
+		rebuilt, err := raidTemp()
+		if err != nil {
+			_ = ret.Close()
+			return nil, err
+		}
+		spools[missing] = rebuilt
+		if xorPieces(rebuilt, others) != nil {
+			_ = ret.Close()
+			return nil, fmt.Errorf("shard size mismatch")
+		}
+	}
+	data := make([]io.Reader, 0)
+	for _, spool := range spools[:len(spools)-1] {
+		data = append(data, spoolReader(spool))
+	}
+	ret.Reader = io.LimitReader(io.MultiReader(data...), size)
+	return ret, nil
+}
+
+func describeRaid(raid string) string {
+	_, shards, _ := getRaid(raid)
+	lines := []string{strings.Split(raids[raid], "\n")[0]}
+	for _, shard := range shards {
+		index := englang.DecimalString(int64(shard.index))
+		if strings.Contains(raids[raid], outOfDateLine(shard)) {
+			lines = append(lines, outOfDateLine(shard))
+			continue
+		}
+		reader, err := readShard(shard)
+		if err != nil {
+			lines = append(lines, englang.Printf("Shard %s on node %s is not available.", index, shard.node))
+			continue
+		}
+		_ = reader.Close()
+		lines = append(lines, englang.Printf("Shard %s on node %s is available.", index, shard.node))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func deleteRaidInternal(raid string) {
+	_, shards, _ := getRaid(raid)
+	for _, shard := range shards {
+		deleteShard(shard)
+	}
+	delete(raids, raid)
+	mesh.DeleteIndex(raid)
+}
+
+func CleanupExpiredRaid(raid string) {
+	if mesh.GetIndex(raid) == "" {
+		// Shards expire on their own nodes.
+		delete(raids, raid)
+	}
+}
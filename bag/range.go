@@ -0,0 +1,95 @@
+package bag
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/englang"
+	"io"
+	"net/http"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Partial writes let pipelines stream logs into a bag without uploading it again.
+// curl -X PATCH -H 'Content-Range: bytes 100-199/*' --data-binary @part https://example.com/tmp?apikey=...
+// curl -X PATCH --data-binary @part 'https://example.com/tmp?apikey=...&offset=100'
+// curl -X PATCH --data-binary @log https://example.com/tmp?apikey=... appends.
+// PUT accepts the same offset and Content-Range or an append=1 parameter.
+// Ranged reads are handled by http.ServeFile with a standard Range header.
+// Writes cannot start beyond the end of the bag leaving holes in it.
+
+// isInPlaceWrite tells, whether the request changes the content in place instead of replacing it.
+func isInPlaceWrite(r *http.Request) bool {
+	_, _, partial, _ := requestedOffset(r)
+	return partial || r.Method == "PATCH" || r.URL.Query().Get("append") != ""
+}
+
+func requestedOffset(r *http.Request) (int64, int64, bool, error) {
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange != "" {
+		var start, end, total string
+		err := englang.Scanf1(contentRange+".", "bytes %s-%s/%s.", &start, &end, &total)
+		if err != nil {
+			return 0, 0, true, err
+		}
+		from := englang.Decimal(start)
+		to := englang.Decimal(end)
+		if from < 0 || to < from || englang.DecimalString(from) != start || englang.DecimalString(to) != end {
+			return 0, 0, true, fmt.Errorf("invalid range")
+		}
+		return from, to - from + 1, true, nil
+	}
+	offset := r.URL.Query().Get("offset")
+	if offset != "" {
+		from := englang.Decimal(offset)
+		if from < 0 || englang.DecimalString(from) != offset {
+			return 0, 0, true, fmt.Errorf("invalid offset")
+		}
+		return from, -1, true, nil
+	}
+	return 0, 0, false, nil
+}
+
+func writeBagAt(p string, key []byte, offset int64, length int64, body io.Reader) error {
+	f, err := openBagWriterAt(p, key, offset)
+	if err != nil {
+		return err
+	}
+	if length >= 0 {
+		body = io.LimitReader(body, length)
+	}
+	_, err = io.Copy(f, body)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendBag(p string, key []byte, body io.Reader) error {
+	return writeBagAt(p, key, -1, -1, body)
+}
+
+func partialWrite(r *http.Request, p string, key []byte) (bool, int) {
+	offset, length, partial, err := requestedOffset(r)
+	if err != nil {
+		return true, http.StatusRequestedRangeNotSatisfiable
+	}
+	if partial {
+		if writeBagAt(p, key, offset, length, r.Body) != nil {
+			return true, http.StatusRequestedRangeNotSatisfiable
+		}
+		return true, http.StatusOK
+	}
+	if r.Method == "PATCH" || r.URL.Query().Get("append") != "" {
+		if appendBag(p, key, r.Body) != nil {
+			return true, http.StatusInternalServerError
+		}
+		return true, http.StatusOK
+	}
+	return false, http.StatusOK
+}
@@ -0,0 +1,103 @@
+package bag
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/billing"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"net/http"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Long-running experiments can keep their bags without downloading and uploading them every week.
+// A fresh coin extends the bag by another ValidPeriod.
+// curl -X PUT --data-binary @coin 'https://example.com/tmp.renew?apikey=<bag>'
+// curl -X PUT 'https://example.com/tmp.renew?apikey=<bag>&voucher=<invoice or voucher>'
+// Newly generated ids are safer. The content can be copied into a new bag key instead.
+// curl -X PUT --data-binary @coin 'https://example.com/tmp.renew?apikey=<bag>&rotate=1'
+// The old bag is left intact until it expires. Larger tiers consume as many vouchers as bought earlier.
+// Vouchers are refunded, if the bag cannot be rotated.
+
+func setupRenewal() {
+	http.HandleFunc("/tmp.renew", func(w http.ResponseWriter, r *http.Request) {
+		if nil == redirectToBagServer(w, r) {
+			return
+		}
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		bag, key := resolveBag(apiKey)
+		if bags[bag] == "" || !mesh.CheckExpiry(bag) {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		units := getBagQuota(bag) / metadata.BagQuota
+		used := billing.RedeemCoinKeys(r.URL.Query().Get("voucher"), r.Body, int(units))
+		if len(used) == 0 {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		renewed := fmt.Sprintf("Voucher used: %s", drawing.RedactPublicKey(used[0]))
+		if r.URL.Query().Get("rotate") != "" {
+			rotated := rotateBagInternal(bag, key)
+			if rotated == "" {
+				billing.RefundCoinUnits(used)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			storageKey, _ := resolveBag(rotated)
+			bags[storageKey] = bags[storageKey] + "\n" + renewed
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(rotated))
+			return
+		}
+		until := renewBagInternal(bag)
+		bags[bag] = bags[bag] + "\n" + renewed
+		management.QuantumGradeAuthorization()
+		_, _ = w.Write([]byte(englang.Printf("Bag is valid until %s.", until.Format("Jan 2, 2006"))))
+	})
+}
+
+func renewBagInternal(bag string) time.Time {
+	until := mesh.ExtendExpiry(bag, ValidPeriod)
+	setBagRecordLine(bag, mesh.ExpiryWarningSent, "")
+	return until
+}
+
+// rotateBagInternal copies a bag into a newly generated key keeping the quota and the encryption.
+func rotateBagInternal(bag string, key []byte) string {
+	rotated := drawing.GenerateUniqueKey()
+	var rotatedKey []byte
+	if key != nil {
+		MakeEncryptedBagInternal(rotated)
+		rotatedKey = bagCipherKey(rotated)
+	} else {
+		MakeBagInternal(rotated)
+	}
+	storageKey, _ := resolveBag(rotated)
+	setBagRecordLine(storageKey, "Bag quota is ", englang.Printf("Bag quota is %s bytes.", englang.DecimalString(getBagQuota(bag))))
+	if copyBagInternal(bag, key, storageKey, rotatedKey) != nil {
+		mesh.DeleteIndex(storageKey)
+		CleanupExpiredbag(storageKey)
+		return ""
+	}
+	target, lead, _ := mesh.GetNotification(bags[bag])
+	if target != "" {
+		setBagRecordLine(storageKey, mesh.NotificationPrefix, mesh.NotificationRecordLine(target, lead))
+	}
+	return rotated
+}
@@ -0,0 +1,198 @@
+package bag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags can be shared with derived keys like DropBox attachments.
+// A read only key allows downloads for a client.
+// A write only key is a drop box for uploads.
+// curl -X PUT 'https://example.com/tmp.share?apikey=<bag>&access=read&hours=24' returns a new key.
+// curl -X PUT 'https://example.com/tmp.share?apikey=<bag>&access=write' returns a drop box key.
+// curl -X GET 'https://example.com/tmp?apikey=<derived>' works on any node.
+// curl -X DELETE 'https://example.com/tmp.share?apikey=<derived>' revokes a derived key.
+// Derived keys are registered in the mesh index like bags.
+// They expire with the bag or earlier, if hours are set.
+// Derived keys are stored, indexed and backed up by their fingerprint, so that backups do not contain them.
+// Derived keys of encrypted bags carry the content key sealed by the derived key itself, so that backups cannot unseal them.
+// The description of a derived key tells its access and validity. It never tells the bag key.
+
+const accessOwner = "owner"
+const accessRead = "read"
+const accessWrite = "write"
+
+func setupShares() {
+	http.HandleFunc("/tmp.share", func(w http.ResponseWriter, r *http.Request) {
+		if nil == redirectToBagServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		if r.Method == "PUT" {
+			bag, key := resolveBag(apiKey)
+			if bags[bag] == "" || !mesh.CheckExpiry(bag) {
+				management.QuantumGradeAuthorization()
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			access := r.URL.Query().Get("access")
+			if access != accessRead && access != accessWrite {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			hours := englang.Decimal(r.URL.Query().Get("hours"))
+			if hours <= 0 || time.Duration(hours)*time.Hour > ValidPeriod {
+				hours = int64(ValidPeriod / time.Hour)
+			}
+			derived := makeShareInternal(bag, key, access, time.Duration(hours)*time.Hour)
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(derived))
+			return
+		}
+		stored := indexKey(apiKey)
+		_, ok := shares[stored]
+		if !ok {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "GET" {
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(getShareDescription(stored)))
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(shares, stored)
+			mesh.DeleteIndex(stored)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+func makeShareInternal(bag string, key []byte, access string, period time.Duration) string {
+	derived := drawing.GenerateUniqueKey()
+	record := englang.Printf("Read only access to bag %s.", bag)
+	if access == accessWrite {
+		record = englang.Printf("Write only access to bag %s.", bag)
+	}
+	record = record + "\n" + englang.Printf("Valid until %s.", time.Now().Add(period).UTC().Format(time.RFC3339))
+	stored := bagFingerprint(derived)
+	if key != nil {
+		record = record + "\n" + englang.Printf("Sealed content key is %s.", hex.EncodeToString(sealShareKey(derived, key)))
+	}
+	shares[stored] = record
+	mesh.RegisterIndex(stored)
+	mesh.SetExpiry(stored, period)
+	return derived
+}
+
+// sealShareKey hides the content key from backups. The same call unseals it.
+// The derived key is never stored next to a sealed content key.
+func sealShareKey(derived string, key []byte) []byte {
+	seal := sha256.Sum256([]byte("Share seal of " + derived))
+	ret := make([]byte, len(key))
+	for i := range key {
+		ret[i] = key[i] ^ seal[i%len(seal)]
+	}
+	return ret
+}
+
+// resolveShare returns the bag, the content key, and the access of a derived key.
+func resolveShare(derived string) (string, []byte, string) {
+	bag, sealed, access := readShare(indexKey(derived))
+	if bag == "" || sealed == nil {
+		return bag, nil, access
+	}
+	return bag, sealShareKey(derived, sealed), access
+}
+
+// readShare returns the bag, the sealed content key, and the access of a stored share, if it is still valid.
+func readShare(stored string) (string, []byte, string) {
+	var bag, access, until string
+	var sealed []byte
+	for _, line := range strings.Split(shares[stored], "\n") {
+		var value string
+		if nil == englang.Scanf1(line, "Read only access to bag %s.", &value) {
+			bag, access = value, accessRead
+		}
+		if nil == englang.Scanf1(line, "Write only access to bag %s.", &value) {
+			bag, access = value, accessWrite
+		}
+		if nil == englang.Scanf1(line, "Valid until %s.", &value) {
+			until = value
+		}
+		if nil == englang.Scanf1(line, "Sealed content key is %s.", &value) {
+			decoded, err := hex.DecodeString(value)
+			if err == nil {
+				sealed = decoded
+			}
+		}
+	}
+	expiry, err := time.Parse(time.RFC3339, until)
+	if bag == "" || err != nil || time.Now().After(expiry) || bags[bag] == "" {
+		return "", nil, ""
+	}
+	return bag, sealed, access
+}
+
+// getShareDescription returns the access and the validity of a derived key without the bag and the sealed key.
+func getShareDescription(stored string) string {
+	ret := make([]string, 0)
+	for _, line := range strings.Split(shares[stored], "\n") {
+		if strings.HasPrefix(line, "Read only access to bag ") {
+			ret = append(ret, "Read only access.")
+		}
+		if strings.HasPrefix(line, "Write only access to bag ") {
+			ret = append(ret, "Write only access.")
+		}
+		if strings.HasPrefix(line, "Valid until ") {
+			ret = append(ret, line)
+		}
+	}
+	return strings.Join(ret, "\n")
+}
+
+// resolveAccess returns the bag, the content key and the access level of an apikey.
+func resolveAccess(apiKey string) (string, []byte, string) {
+	_, isShare := shares[indexKey(apiKey)]
+	if isShare {
+		return resolveShare(apiKey)
+	}
+	bag, key := resolveBag(apiKey)
+	return bag, key, accessOwner
+}
+
+func accessAllows(access string, method string) bool {
+	switch access {
+	case accessOwner:
+		return true
+	case accessRead:
+		return method == "GET" || method == "HEAD" || method == "COPY"
+	case accessWrite:
+		return method == "PUT" || method == "PATCH"
+	}
+	return false
+}
+
+func CleanupExpiredShare(stored string) {
+	bag, _, _ := readShare(stored)
+	if bag == "" || mesh.GetIndex(stored) == "" {
+		delete(shares, stored)
+		mesh.DeleteIndex(stored)
+	}
+}
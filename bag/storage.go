@@ -0,0 +1,102 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags are stored as files in metadata.StorageRoot, a dedicated volume on most nodes.
+// There is no other backend. Network or object storage can be mounted at the root.
+// The node quota is metadata.StorageQuota, or the free disk space, whichever is smaller.
+// Nodes report their available space to the mesh periodically.
+// Bags are bought on a node with space, and uploads are rejected with 507, when the node is full.
+// The usage of each bag is measured, when it is written or deleted, so that the node usage is a sum of bags.
+
+var storageUsages = map[string]int64{}
+var storageUsagesLock = sync.Mutex{}
+
+func setupStorage() {
+	root := os.Getenv("STORAGEROOT")
+	if root != "" {
+		metadata.StorageRoot = root
+	}
+	drawing.NoErrorVoid(os.MkdirAll(metadata.StorageRoot, 0700))
+	go reportStorage()
+}
+
+// storageUsage returns the bytes used by bags. Bags not measured yet, like restored ones, are measured once.
+func storageUsage() int64 {
+	storageUsagesLock.Lock()
+	defer storageUsagesLock.Unlock()
+	used := int64(0)
+	for bag := range bags {
+		usage, ok := storageUsages[bag]
+		if !ok {
+			usage = bagUsage(bag) + bagVersionsUsage(bag)
+			storageUsages[bag] = usage
+		}
+		used = used + usage
+	}
+	return used
+}
+
+// updateStorageUsage measures a bag again after it was written.
+func updateStorageUsage(bag string) {
+	usage := bagUsage(bag) + bagVersionsUsage(bag)
+	storageUsagesLock.Lock()
+	storageUsages[bag] = usage
+	storageUsagesLock.Unlock()
+}
+
+func forgetStorageUsage(bag string) {
+	storageUsagesLock.Lock()
+	delete(storageUsages, bag)
+	storageUsagesLock.Unlock()
+}
+
+// storageAvailable returns the bytes that can still be written on this node.
+func storageAvailable() int64 {
+	available := freeSpace(metadata.StorageRoot)
+	if metadata.StorageQuota > 0 {
+		quota := metadata.StorageQuota - storageUsage()
+		if available < 0 || quota < available {
+			available = quota
+		}
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+func hasStorageForNewBag() bool {
+	return storageAvailable() > metadata.StorageReserve
+}
+
+func hasStorageForUpload(length int64) bool {
+	available := storageAvailable()
+	return available > 0 && length <= available
+}
+
+func reportStorage() {
+	for {
+		mesh.ReportStorage(storageAvailable() - metadata.StorageReserve)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func GetBagPathInternal(bag string) string {
+	return path.Join(metadata.StorageRoot, bag)
+}
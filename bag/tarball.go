@@ -0,0 +1,241 @@
+package bag
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"gitlab.com/eper.io/engine/englang"
+	"io"
+	"net/http"
+	"os"
+	"path"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Complex datasets and directories are put into tarballs.
+// Bags can browse them without downloading everything.
+// curl -X GET 'https://example.com/tmp?apikey=...&list=1' lists tar and tar.gz members.
+// curl -X GET 'https://example.com/tmp?apikey=...&member=reports/q3.csv' streams a single member.
+// curl -X PUT --data-binary @q3.csv 'https://example.com/tmp?apikey=...&member=reports/q3.csv' replaces or adds one.
+// This makes bags a lightweight artifact store for continuous integration outputs.
+
+func openTarball(p string, key []byte) (*tar.Reader, bool, func(), error) {
+	f, err := openBagReader(p, key)
+	if err != nil {
+		return nil, false, func() {}, err
+	}
+	buffered := bufio.NewReader(f)
+	magic, _ := buffered.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			_ = f.Close()
+			return nil, true, func() {}, err
+		}
+		return tar.NewReader(unzipped), true, func() { _ = unzipped.Close(); _ = f.Close() }, nil
+	}
+	return tar.NewReader(buffered), false, func() { _ = f.Close() }, nil
+}
+
+func listTarball(w io.Writer, p string, key []byte) error {
+	return listTarballMembers(w, p, key, 0)
+}
+
+// listTarballMembers lists up to limit members, or all of them, if limit is zero.
+// It stops reading there, so that a preview does not need to unzip the whole tarball.
+func listTarballMembers(w io.Writer, p string, key []byte, limit int) error {
+	reader, _, closer, err := openTarball(p, key)
+	defer closer()
+	if err != nil {
+		return err
+	}
+	for listed := 0; limit == 0 || listed < limit; listed++ {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			_, err = io.WriteString(w, englang.Printf("Directory %s.\n", header.Name))
+		} else {
+			_, err = io.WriteString(w, englang.Printf("File %s has %s bytes.\n", header.Name, englang.DecimalString(header.Size)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findTarballMember(p string, key []byte, member string, found func(header *tar.Header, content io.Reader) error) error {
+	reader, _, closer, err := openTarball(p, key)
+	defer closer()
+	if err != nil {
+		return err
+	}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("not found")
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean(header.Name) == path.Clean(member) && header.Typeflag != tar.TypeDir {
+			return found(header, reader)
+		}
+	}
+}
+
+func replaceTarballMember(p string, key []byte, member string, body io.Reader) error {
+	// The body is spooled first, tar headers need the size in advance.
+	spool, err := os.CreateTemp(path.Dir(p), "member")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = spool.Close(); _ = os.Remove(spool.Name()) }()
+	size, err := io.Copy(spool, body)
+	if err != nil {
+		return err
+	}
+
+	temporary, err := os.CreateTemp(path.Dir(p), "tarball")
+	if err != nil {
+		return err
+	}
+	stagedName := temporary.Name()
+	_ = temporary.Close()
+	defer func() { _ = os.Remove(stagedName) }()
+	staged, err := createBagWriter(stagedName, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = staged.Close() }()
+
+	reader, zipped, closer, err := openTarball(p, key)
+	defer closer()
+	if err != nil {
+		return err
+	}
+	var out io.Writer = staged
+	var zipper *gzip.Writer
+	if zipped {
+		zipper = gzip.NewWriter(staged)
+		out = zipper
+	}
+	writer := tar.NewWriter(out)
+	replaced := false
+	writeMember := func(header tar.Header) error {
+		header.Size = size
+		err := writer.WriteHeader(&header)
+		if err != nil {
+			return err
+		}
+		_, err = spool.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, spool)
+		return err
+	}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean(header.Name) == path.Clean(member) && header.Typeflag != tar.TypeDir {
+			err = writeMember(*header)
+			replaced = true
+		} else {
+			err = writer.WriteHeader(header)
+			if err == nil {
+				_, err = io.Copy(writer, reader)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !replaced {
+		err = writeMember(tar.Header{Name: path.Clean(member), Mode: 0600, Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Close()
+	if err == nil && zipper != nil {
+		err = zipper.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = staged.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(stagedName, p)
+}
+
+// isTarball reads the first header of the bag, so that requests can be rejected before anything is written.
+func isTarball(p string, key []byte) bool {
+	reader, _, closer, err := openTarball(p, key)
+	defer closer()
+	if err != nil {
+		return false
+	}
+	_, err = reader.Next()
+	return err == nil
+}
+
+// serveTarball lists or streams members. Errors after the reply started stop it without writing anything else.
+func serveTarball(w http.ResponseWriter, r *http.Request, p string, key []byte) bool {
+	if r.URL.Query().Get("list") != "" {
+		if !isTarball(p, key) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = io.WriteString(w, "The bag is not a tarball.\n")
+			return true
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_ = listTarball(w, p, key)
+		return true
+	}
+	member := r.URL.Query().Get("member")
+	if member != "" {
+		started := false
+		err := findTarballMember(p, key, member, func(header *tar.Header, content io.Reader) error {
+			started = true
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", englang.DecimalString(header.Size))
+			_, err := io.Copy(w, content)
+			return err
+		})
+		if err != nil && !started {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return true
+	}
+	return false
+}
+
+func replaceMember(r *http.Request, p string, key []byte) (bool, int) {
+	member := r.URL.Query().Get("member")
+	if member == "" {
+		return false, http.StatusOK
+	}
+	if replaceTarballMember(p, key, member, r.Body) != nil {
+		return true, http.StatusUnprocessableEntity
+	}
+	return true, http.StatusOK
+}
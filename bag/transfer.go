@@ -0,0 +1,122 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags can be copied and moved to other bags without the client relaying the bytes.
+// curl -X COPY 'https://example.com/tmp?apikey=<bag>&destination=<other bag>'
+// curl -X MOVE -H 'Destination: <other bag>' 'https://example.com/tmp?apikey=<bag>&name=reports/q3.csv'
+// A whole bag is copied with its named objects. Existing objects of the destination are kept.
+// A named object is copied into the same name.
+// Local bags are written under their lock with the quota and storage checks of an upload.
+// Bags on other nodes get a PUT through the mesh, so that their quota and access rules apply.
+// Read only keys can copy. Moving needs the owner key. Write only keys are valid destinations.
+
+func requestedDestination(r *http.Request) string {
+	destination := r.URL.Query().Get("destination")
+	if destination == "" {
+		destination = r.Header.Get("Destination")
+	}
+	return destination
+}
+
+func transferBag(bag string, key []byte, name string, destination string, move bool) int {
+	if destination == "" {
+		return http.StatusBadRequest
+	}
+	target, _, _ := resolveAccess(destination)
+	if target == bag {
+		return http.StatusConflict
+	}
+	names := []string{name}
+	if name == "" {
+		names = append(names, listBagObjects(bag, "")...)
+	}
+	for _, n := range names {
+		p := GetBagPathInternal(bag)
+		if n != "" {
+			p = GetBagObjectPathInternal(bag, n)
+		}
+		status := transferObject(p, key, n, destination)
+		if status != http.StatusOK {
+			return status
+		}
+	}
+	if move {
+		deleteBagContent(bag, name)
+	}
+	return http.StatusOK
+}
+
+func transferObject(p string, key []byte, name string, destination string) int {
+	reader, err := openBagReader(p, key)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer func() { _ = reader.Close() }()
+	node := mesh.GetIndex(indexKey(destination))
+	if node == "" {
+		node = mesh.GetIndex(bagFingerprint(destination))
+	}
+	if node == "" || node == mesh.WhoAmI {
+		return storeBagObject(destination, name, reader, bagSize(p, key))
+	}
+	call := englang.Printf("%s/tmp?apikey=%s", node, destination)
+	if name != "" {
+		call = call + "&name=" + url.QueryEscape(name)
+	}
+	reply, err := mesh.OpenPeerRequest(call, "PUT", reader)
+	if err != nil {
+		return http.StatusBadGateway
+	}
+	_ = reply.Close()
+	return http.StatusOK
+}
+
+// storeBagObject writes a local bag the same way as an upload does.
+// The caller holds the lock of the destination bag.
+func storeBagObject(destination string, name string, body io.Reader, length int64) int {
+	bag, key, access := resolveAccess(destination)
+	if !accessAllows(access, "PUT") || bags[bag] == "" || !mesh.CheckExpiry(indexKey(destination)) {
+		return http.StatusUnauthorized
+	}
+	if !hasStorageForUpload(length) {
+		return http.StatusInsufficientStorage
+	}
+	p := GetBagPathInternal(bag)
+	if name != "" {
+		p = GetBagObjectPathInternal(bag, name)
+		if p == "" {
+			return http.StatusBadRequest
+		}
+		drawing.NoErrorVoid(os.MkdirAll(path.Dir(p), 0700))
+	}
+	r, err := http.NewRequest("PUT", "/tmp", body)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	r.ContentLength = length
+	limited := &quotaReader{reader: body, left: uploadAllowance(bag, r, p)}
+	r.Body = limited
+	status := uploadBag(r, bag, name, p, key)
+	if limited.exceeded {
+		status = http.StatusRequestEntityTooLarge
+	}
+	updateBagDigest(bag, name, p, key)
+	return status
+}
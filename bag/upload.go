@@ -0,0 +1,302 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Large files can be uploaded in numbered chunks that survive dropped connections.
+// curl -X POST 'https://example.com/tmp.upload?apikey=<bag>&name=reports/q3.csv&chunks=3' returns an upload id.
+// curl -X PUT --data-binary @chunk0 'https://example.com/tmp.upload?apikey=<bag>&upload=<id>&chunk=0'
+// curl -X GET 'https://example.com/tmp.upload?apikey=<bag>&upload=<id>' lists the chunks received so far.
+// curl -X DELETE 'https://example.com/tmp.upload?apikey=<bag>&upload=<id>' abandons the upload.
+// Chunks can be sent in any order and again, if a connection was dropped.
+// The bag is replaced atomically, when the last missing chunk arrives.
+// The last chunk can carry If-Match or If-None-Match like a PUT to /tmp. The upload is kept, if it fails.
+// Chunks of encrypted bags are encrypted like the bag itself.
+
+const maxUploadChunks = 10000
+
+func setupUploads() {
+	http.HandleFunc("/tmp.upload", func(w http.ResponseWriter, r *http.Request) {
+		if nil == redirectToBagServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		bag, key, access := resolveAccess(apiKey)
+		if !accessAllows(access, "PUT") || bags[bag] == "" || !mesh.CheckExpiry(indexKey(apiKey)) {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			name := r.URL.Query().Get("name")
+			if name != "" && GetBagObjectPathInternal(bag, name) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			chunks := englang.Decimal(r.URL.Query().Get("chunks"))
+			if chunks <= 0 || chunks > maxUploadChunks {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(startUploadInternal(bag, name, chunks)))
+			return
+		}
+		id := r.URL.Query().Get("upload")
+		uploadBag, name, chunks := getUpload(id)
+		if uploadBag == "" || uploadBag != bag {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "PUT" {
+			chunk := englang.Decimal(r.URL.Query().Get("chunk"))
+			if r.URL.Query().Get("chunk") == "" || chunk < 0 || chunk >= chunks {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !hasStorageForUpload(r.ContentLength) {
+				w.WriteHeader(http.StatusInsufficientStorage)
+				return
+			}
+			status := writeChunkInternal(id, key, chunk, r.Body)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			if len(missingChunks(id, chunks)) > 0 {
+				_, _ = w.Write([]byte(englang.Printf("Chunks %s are missing.", describeMissingChunks(id, chunks))))
+				return
+			}
+			unlock := lockBag(bag)
+			defer unlock()
+			status = checkPreconditions(r, bagETag(bag, name, getBagTargetPath(bag, name), key))
+			if status == 0 {
+				status = commitUploadInternal(id, key)
+			}
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			writeRecordedDigestHeader(w, bag, name)
+			return
+		}
+		if r.Method == "GET" {
+			management.QuantumGradeAuthorization()
+			for _, chunk := range listChunks(id) {
+				stat, err := os.Stat(getChunkPath(id, chunk))
+				if err == nil {
+					_, _ = w.Write([]byte(englang.Printf("Chunk %s has %s bytes.\n", englang.DecimalString(chunk), englang.DecimalString(stat.Size()))))
+				}
+			}
+			return
+		}
+		if r.Method == "DELETE" {
+			deleteUploadInternal(id)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+func startUploadInternal(bag string, name string, chunks int64) string {
+	id := drawing.GenerateUniqueKey()
+	uploads[id] = englang.Printf("Upload of %s chunks to object %s of bag %s.", englang.DecimalString(chunks), name, bag)
+	drawing.NoErrorVoid(os.MkdirAll(getChunksPathInternal(id), 0700))
+	return id
+}
+
+func getUpload(id string) (string, string, int64) {
+	var chunks, bag, name string
+	if nil != englang.Scanf1(uploads[id], "Upload of %s chunks to object %s of bag %s.", &chunks, &name, &bag) {
+		return "", "", 0
+	}
+	return bag, name, englang.Decimal(chunks)
+}
+
+func getChunksPathInternal(id string) string {
+	return path.Join(metadata.StorageRoot, id+".chunks")
+}
+
+func getChunkPath(id string, chunk int64) string {
+	return path.Join(getChunksPathInternal(id), englang.DecimalString(chunk))
+}
+
+func listChunks(id string) []int64 {
+	ret := make([]int64, 0)
+	entries, _ := os.ReadDir(getChunksPathInternal(id))
+	for _, entry := range entries {
+		chunk := englang.Decimal(entry.Name())
+		if englang.DecimalString(chunk) == entry.Name() {
+			ret = append(ret, chunk)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func missingChunks(id string, chunks int64) []int64 {
+	received := map[int64]bool{}
+	for _, chunk := range listChunks(id) {
+		received[chunk] = true
+	}
+	ret := make([]int64, 0)
+	for i := int64(0); i < chunks; i++ {
+		if !received[i] {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+func uploadedBytes(id string) int64 {
+	total := int64(0)
+	for _, chunk := range listChunks(id) {
+		stat, err := os.Stat(getChunkPath(id, chunk))
+		if err == nil {
+			total = total + stat.Size()
+		}
+	}
+	return total
+}
+
+// writeChunkInternal stores a chunk. The chunk is renamed in place, so that a dropped connection leaves no partial chunk.
+func writeChunkInternal(id string, key []byte, chunk int64, body io.Reader) int {
+	bag, name, _ := getUpload(id)
+	p := getBagTargetPath(bag, name)
+	previous := int64(0)
+	stat, err := os.Stat(getChunkPath(id, chunk))
+	if err == nil {
+		previous = stat.Size()
+	}
+	replaced := int64(0)
+	stat, err = os.Stat(p)
+	if err == nil {
+		replaced = stat.Size()
+	}
+	limited := &quotaReader{reader: body, left: getBagQuota(bag) - bagUsage(bag) + replaced - uploadedBytes(id) + previous}
+	err = writeBagFileAtomic(getChunkPath(id, chunk), key, limited)
+	if limited.exceeded {
+		return http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// commitUploadInternal replaces the bag or the named object with the chunks in order.
+// The caller holds the lock of the bag. The quota is checked again, because other writes may have happened since the chunks arrived.
+func commitUploadInternal(id string, key []byte) int {
+	bag, name, chunks := getUpload(id)
+	if len(missingChunks(id, chunks)) > 0 {
+		return http.StatusConflict
+	}
+	p := getBagTargetPath(bag, name)
+	replaced := int64(0)
+	stat, err := os.Stat(p)
+	if err == nil {
+		replaced = stat.Size()
+	}
+	if uploadedBytes(id) > getBagQuota(bag)-bagUsage(bag)+replaced {
+		return http.StatusRequestEntityTooLarge
+	}
+	drawing.NoErrorVoid(os.MkdirAll(path.Dir(p), 0700))
+	reader := &chunkReader{id: id, key: key, chunks: chunks}
+	defer func() { _ = reader.Close() }()
+	err = replaceBagFile(bag, name, p, key, reader)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	updateBagDigest(bag, name, p, key)
+	deleteUploadInternal(id)
+	return http.StatusOK
+}
+
+// chunkReader reads the chunks of an upload in order keeping a single file open.
+type chunkReader struct {
+	id      string
+	key     []byte
+	chunks  int64
+	next    int64
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if c.next == c.chunks {
+				return 0, io.EOF
+			}
+			chunk, err := openBagReader(getChunkPath(c.id, c.next), c.key)
+			if err != nil {
+				return 0, err
+			}
+			c.current = chunk
+			c.next++
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			_ = c.current.Close()
+			c.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+func getBagTargetPath(bag string, name string) string {
+	if name == "" {
+		return GetBagPathInternal(bag)
+	}
+	return GetBagObjectPathInternal(bag, name)
+}
+
+func deleteUploadInternal(id string) {
+	_ = os.RemoveAll(getChunksPathInternal(id))
+	delete(uploads, id)
+}
+
+func CleanupExpiredUpload(id string) {
+	bag, _, _ := getUpload(id)
+	if bag == "" || bags[bag] == "" {
+		deleteUploadInternal(id)
+	}
+}
+
+func describeMissingChunks(id string, chunks int64) string {
+	missing := make([]string, 0)
+	for _, chunk := range missingChunks(id, chunks) {
+		missing = append(missing, englang.DecimalString(chunk))
+	}
+	return strings.Join(missing, ", ")
+}
@@ -0,0 +1,179 @@
+package bag
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bags are replaced atomically. New content is staged in a temporary file and renamed into place.
+// Readers see either the old or the new content, and a failed upload leaves the old content intact.
+// The last metadata.BagVersions contents replaced are kept until the bag expires.
+// curl -X GET 'https://example.com/tmp?apikey=<bag>&versions=1' lists the versions kept.
+// curl -X GET 'https://example.com/tmp?apikey=<bag>&version=3' downloads a version.
+// curl -X PUT 'https://example.com/tmp?apikey=<bag>&rollback=3' restores a version as a new content.
+// Named objects have their own versions with &name=.
+// Partial writes and appends change the content in place, and they are not versioned.
+// Versions use node storage, but they are not counted in the bag quota.
+
+func getBagVersionsPathInternal(bag string, name string) string {
+	return path.Join(metadata.StorageRoot, bag+".versions", url.PathEscape("/"+name))
+}
+
+func getBagVersionPath(bag string, name string, version int64) string {
+	return path.Join(getBagVersionsPathInternal(bag, name), englang.DecimalString(version))
+}
+
+func listBagVersions(bag string, name string) []int64 {
+	ret := make([]int64, 0)
+	entries, _ := os.ReadDir(getBagVersionsPathInternal(bag, name))
+	for _, entry := range entries {
+		version := englang.Decimal(entry.Name())
+		if englang.DecimalString(version) == entry.Name() {
+			ret = append(ret, version)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// keepBagVersion links the current content as the next version, and it drops the oldest ones.
+func keepBagVersion(bag string, name string, p string) {
+	if metadata.BagVersions <= 0 {
+		return
+	}
+	_, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	versions := listBagVersions(bag, name)
+	next := int64(1)
+	if len(versions) > 0 {
+		next = versions[len(versions)-1] + 1
+	}
+	drawing.NoErrorVoid(os.MkdirAll(getBagVersionsPathInternal(bag, name), 0700))
+	kept := getBagVersionPath(bag, name, next)
+	if os.Link(p, kept) != nil {
+		if copyFile(p, kept) != nil {
+			return
+		}
+	}
+	versions = append(versions, next)
+	for len(versions) > metadata.BagVersions {
+		_ = os.Remove(getBagVersionPath(bag, name, versions[0]))
+		versions = versions[1:]
+	}
+}
+
+func copyFile(from string, to string) error {
+	reader, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	writer, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stageBagFile writes content into a temporary file next to the bags.
+func stageBagFile(key []byte, body io.Reader) (string, error) {
+	staged := path.Join(metadata.StorageRoot, drawing.GenerateUniqueKey()+".upload")
+	f, err := createBagWriter(staged, key)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(staged)
+		return "", err
+	}
+	return staged, nil
+}
+
+// writeBagFileAtomic writes into a temporary file next to the bags, and it renames it to the final place.
+// Readers see either the old or the new content.
+func writeBagFileAtomic(p string, key []byte, body io.Reader) error {
+	staged, err := stageBagFile(key, body)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(staged, p)
+	if err != nil {
+		_ = os.Remove(staged)
+	}
+	return err
+}
+
+// replaceBagFile writes a new content of a bag or a named object keeping the previous one as a version.
+func replaceBagFile(bag string, name string, p string, key []byte, body io.Reader) error {
+	staged, err := stageBagFile(key, body)
+	if err != nil {
+		return err
+	}
+	keepBagVersion(bag, name, p)
+	err = os.Rename(staged, p)
+	if err != nil {
+		_ = os.Remove(staged)
+	}
+	return err
+}
+
+func rollbackBag(bag string, name string, p string, key []byte, version int64) int {
+	reader, err := openBagReader(getBagVersionPath(bag, name, version), key)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer func() { _ = reader.Close() }()
+	if replaceBagFile(bag, name, p, key, reader) != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func writeBagVersionList(w io.Writer, bag string, name string, key []byte) {
+	for _, version := range listBagVersions(bag, name) {
+		size := bagSize(getBagVersionPath(bag, name, version), key)
+		drawing.NoErrorWrite(w.Write([]byte(englang.Printf("Version %s has %s bytes.\n", englang.DecimalString(version), englang.DecimalString(size)))))
+	}
+}
+
+func bagVersionsUsage(bag string) int64 {
+	used := int64(0)
+	_ = filepath.Walk(path.Join(metadata.StorageRoot, bag+".versions"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			used = used + info.Size()
+		}
+		return nil
+	})
+	return used
+}
+
+func deleteBagVersions(bag string) {
+	_ = os.RemoveAll(path.Join(metadata.StorageRoot, bag+".versions"))
+}
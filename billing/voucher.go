@@ -9,6 +9,7 @@ import (
 	"gitlab.com/eper.io/engine/metadata"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -172,22 +173,8 @@ func ListVouchers(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetCoinFile(invoiceCandidate string, writer *bufio.Writer) {
-	for key, voucher := range vouchers {
-		// ApiKey may point to a voucher directly
-		if strings.Contains(voucher, invoiceCandidate) {
-			var companyHeader string
-			var issued string
-			var invoice string
-			var status string = ""
-			err := englang.Scanf(voucher, metadata.VoucherPattern,
-				&companyHeader, &issued, &invoice, &status)
-			if err == nil && status == "Status is valid." {
-				t, err := time.Parse("Jan 2, 2006", issued)
-				if err == nil && t.Add(365*24*time.Hour).After(time.Now()) {
-					_, _ = writer.WriteString(fmt.Sprintf("%s/voucher.html?apikey=%s\n", metadata.SiteUrl, key))
-				}
-			}
-		}
+	for _, key := range validVoucherKeys(invoiceCandidate, "") {
+		_, _ = writer.WriteString(fmt.Sprintf("%s/voucher.html?apikey=%s\n", metadata.SiteUrl, key))
 	}
 	_, _ = writer.WriteString("Used, expired, invalid, refunded vouchers:\n")
 	for key, voucher := range vouchers {
@@ -229,6 +216,105 @@ func ValidatedCoinContent(w http.ResponseWriter, r *http.Request) string {
 	return ""
 }
 
+// ValidatedCoinUnits consumes several vouchers at once to buy a larger tier of a service.
+// Either all the vouchers are used or none of them.
+func ValidatedCoinUnits(w http.ResponseWriter, r *http.Request, units int) string {
+	if units <= 1 {
+		return ValidatedCoinContent(w, r)
+	}
+	return RedeemCoinUnits(r.URL.Query().Get("apikey"), r.Body, units)
+}
+
+// RedeemCoinUnits uses vouchers of an invoice or voucher key, or the vouchers listed in a coin file.
+func RedeemCoinUnits(apiKey string, coin io.Reader, units int) string {
+	used := RedeemCoinKeys(apiKey, coin, units)
+	if len(used) == 0 {
+		return ""
+	}
+	return used[0]
+}
+
+// RedeemCoinKeys returns all the vouchers used, so that they can be refunded, if the service fails.
+// Each voucher is counted once, and the used ones are restored, if there are not enough of them.
+func RedeemCoinKeys(apiKey string, coin io.Reader, units int) []string {
+	if units < 1 {
+		units = 1
+	}
+	candidates := voucherKeysOf(apiKey)
+	if len(candidates) == 0 {
+		scanner := bufio.NewScanner(coin)
+		for scanner.Scan() {
+			var voucher, begin, end, site string
+			err := englang.ScanfContains(scanner.Text()+".", "http%s/voucher.html?apikey=%s.", &begin, &site, &voucher, &end)
+			if err == nil {
+				candidates = append(candidates, voucherKeysOf(voucher)...)
+			}
+		}
+	}
+	management.QuantumGradeAuthorization()
+	used := make([]string, 0)
+	seen := map[string]bool{}
+	for _, key := range candidates {
+		if len(used) == units {
+			break
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ok, _, _, _ := ValidateVoucherKey(key, true)
+		if ok {
+			used = append(used, key)
+		}
+	}
+	if len(used) < units {
+		RefundCoinUnits(used)
+		return []string{}
+	}
+	return used
+}
+
+// RefundCoinUnits makes used vouchers valid again, if the service was not provided.
+func RefundCoinUnits(keys []string) {
+	for _, key := range keys {
+		voucher, ok := vouchers[key]
+		if ok && strings.Contains(voucher, "Status is used.") {
+			vouchers[key] = strings.Replace(voucher, "Status is used.", "Status is valid.", 1)
+		}
+	}
+}
+
+// voucherKeysOf returns the valid vouchers of an invoice or a voucher key.
+func voucherKeysOf(apiKey string) []string {
+	if apiKey == "" {
+		return []string{}
+	}
+	return validVoucherKeys(fmt.Sprintf(VoucherInvoicePointer, metadata.SiteUrl, apiKey), apiKey)
+}
+
+// validVoucherKeys returns the valid vouchers issued for an invoice or having the key.
+func validVoucherKeys(invoiceCandidate string, apiKey string) []string {
+	ret := make([]string, 0)
+	for key, voucher := range vouchers {
+		if apiKey == key || strings.Contains(voucher, invoiceCandidate) {
+			var companyHeader string
+			var issued string
+			var invoice string
+			var status string = ""
+			err := englang.Scanf(voucher, metadata.VoucherPattern,
+				&companyHeader, &issued, &invoice, &status)
+			if err == nil && status == "Status is valid." {
+				t, err := time.Parse("Jan 2, 2006", issued)
+				if err == nil && t.Add(365*24*time.Hour).After(time.Now()) {
+					ret = append(ret, key)
+				}
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func ValidateVoucher(w http.ResponseWriter, r *http.Request, consume bool) (bool, bool, string, string) {
 	apiKey := r.URL.Query().Get("apikey")
 	return ValidateVoucherKey(apiKey, consume)
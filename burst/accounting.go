@@ -0,0 +1,74 @@
+package burst
+
+import (
+	"gitlab.com/eper.io/engine/englang"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Each run is capped by metadata.BurstMemory, metadata.BurstCpuTime and metadata.BurstOutput.
+// Each run adds to the totals of the burst session. This is the basis of metered billing.
+// The recent runs are kept as accounting lines, so that the session does not grow with each run.
+// curl -X GET 'https://example.com/run.coin?apikey=<burst>' returns the session with the totals and the recent runs.
+// Runs so far are 52 taking 62400 milliseconds using 49400 cpu milliseconds with 6240 bytes in and 212992 bytes out.
+// Run at 2023-06-01 10:00:00 took 1200 milliseconds using 950 cpu milliseconds with 120 bytes in and 4096 bytes out.
+
+const runRecordPattern = "Run at %s took %s milliseconds using %s cpu milliseconds with %s bytes in and %s bytes out."
+const runTotalPattern = "Runs so far are %s taking %s milliseconds using %s cpu milliseconds with %s bytes in and %s bytes out."
+const maxRunHistory = 10
+
+func recordRun(burst string, started time.Time, cpu int64, in int, out int) {
+	took := time.Now().Sub(started).Milliseconds()
+	line := englang.Printf(runRecordPattern, started.UTC().Format("2006-01-02 15:04:05"),
+		englang.DecimalString(took), englang.DecimalString(cpu),
+		englang.DecimalString(int64(in)), englang.DecimalString(int64(out)))
+	lock.Lock()
+	defer lock.Unlock()
+	record, ok := BurstSession[burst]
+	if !ok {
+		return
+	}
+	totals := []int64{1, took, cpu, int64(in), int64(out)}
+	// Sessions from before the totals count their run lines once.
+	runs := []int64{0, 0, 0, 0, 0}
+	counted := false
+	lines := strings.Split(record, "\n")
+	history := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		previous := make([]string, len(totals))
+		if nil == englang.Scanf1(lines[i], runTotalPattern, &previous[0], &previous[1], &previous[2], &previous[3], &previous[4]) {
+			for j := range totals {
+				totals[j] = totals[j] + englang.Decimal(previous[j])
+			}
+			counted = true
+			lines = append(lines[:i], lines[i+1:]...)
+			continue
+		}
+		var at string
+		if nil == englang.Scanf1(lines[i], runRecordPattern, &at, &previous[1], &previous[2], &previous[3], &previous[4]) {
+			runs[0]++
+			for j := 1; j < len(runs); j++ {
+				runs[j] = runs[j] + englang.Decimal(previous[j])
+			}
+			history++
+			if history >= maxRunHistory {
+				lines = append(lines[:i], lines[i+1:]...)
+			}
+		}
+	}
+	if !counted {
+		for j := range totals {
+			totals[j] = totals[j] + runs[j]
+		}
+	}
+	total := englang.Printf(runTotalPattern, englang.DecimalString(totals[0]), englang.DecimalString(totals[1]),
+		englang.DecimalString(totals[2]), englang.DecimalString(totals[3]), englang.DecimalString(totals[4]))
+	BurstSession[burst] = strings.Join(append(lines, total, line), "\n")
+}
@@ -34,6 +34,7 @@ import (
 // This makes burst more secure and easier to use just like a bash script.
 // Bursts are typically docker containers with php/java/node preloaded by the taste of the cloud farm.
 // They keep checking the frontend for new tasks and they restart when done.
+// The box itself is trusted code. It runs the burst code in the sandbox of burst/sandbox with the limits of metadata.
 
 func RunBox() error {
 	for {
@@ -2,8 +2,10 @@ package burst
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"gitlab.com/eper.io/engine/billing"
+	"gitlab.com/eper.io/engine/burst/sandbox"
 	"gitlab.com/eper.io/engine/drawing"
 	"gitlab.com/eper.io/engine/englang"
 	"gitlab.com/eper.io/engine/management"
@@ -42,6 +44,11 @@ var firstRun = true
 
 func Setup() {
 	stateful.RegisterModuleForBackup(&BurstSession)
+	stateful.RegisterModuleForBackup(&BurstSchedules)
+	setupNotifications()
+	setupJobs()
+	setupPipelines()
+	setupSchedules()
 
 	http.HandleFunc("/run", func(writer http.ResponseWriter, request *http.Request) {
 		apiKey := request.URL.Query().Get("apikey")
@@ -54,29 +61,8 @@ func Setup() {
 		}
 
 		input := drawing.NoErrorString(io.ReadAll(request.Body))
-		callChannel := make(chan string)
-
-		select {
-		case <-time.After(MaxBurstRuntime):
-			break
-		case code <- callChannel:
-			break
-		}
-
-		select {
-		case <-time.After(MaxBurstRuntime):
-			break
-		case callChannel <- input:
-			break
-		}
-
-		select {
-		case <-time.After(MaxBurstRuntime + MaxBurstRuntime):
-			break
-		case output := <-callChannel:
-			drawing.NoErrorWrite64(io.Copy(writer, bytes.NewBuffer([]byte(output))))
-			break
-		}
+		result, _ := runBurst(apiKey, input, MaxBurstRuntime, nil)
+		writeResult(writer, result)
 	})
 	http.HandleFunc("/idle", func(writer http.ResponseWriter, request *http.Request) {
 		apiKey := request.URL.Query().Get("apikey")
@@ -132,7 +118,7 @@ func Setup() {
 			return
 		}
 		if request.Method == "PUT" {
-			// TODO Get container result
+			// The box sends the result record.
 			result := drawing.NoErrorString(io.ReadAll(request.Body))
 			lock.Lock()
 			replyCh, ok := ContainerResults[apiKey]
@@ -159,10 +145,10 @@ func Setup() {
 					defer lock.Unlock()
 					// TODO generate new?
 					burst := coinToUse
-					// TODO cleanup
 					BurstSession[burst] = englang.Printf(fmt.Sprintf("Burst chain api created from %s is %s/run.coin?apikey=%s. Chain is valid until %s.", coinToUse, metadata.Http11Port, burst, time.Now().Add(24*time.Hour).String()))
 					mesh.SetExpiry(burst, ValidPeriod)
 					mesh.RegisterIndex(burst)
+					BurstSession[burst] = BurstSession[burst] + "\n" + mesh.ExpiryRecordLine(burst)
 					// TODO cleanup
 					// mesh.SetIndex(burst, mesh.WhoAmI)
 					management.QuantumGradeAuthorization()
@@ -199,3 +185,42 @@ func Setup() {
 		}()
 	}
 }
+
+// runBurst hands the input over to the next idle box, and it returns the result with the final status of the job.
+// The input waits for a box up to the queue time. Jobs and pipeline steps are notified, when a box takes it.
+func runBurst(apiKey string, input string, queue time.Duration, running func()) (sandbox.Result, string) {
+	callChannel := make(chan string)
+
+	select {
+	case <-time.After(queue):
+		return sandbox.Failure(fmt.Errorf("%w waiting for an idle box", sandbox.ErrTimeout)), JobTimedOut
+	case code <- callChannel:
+		break
+	}
+
+	started := time.Now()
+	select {
+	case <-time.After(MaxBurstRuntime):
+		return sandbox.Failure(errors.New("burst box did not take the input")), JobFailed
+	case callChannel <- input:
+		if running != nil {
+			running()
+		}
+		break
+	}
+
+	result := sandbox.Failure(fmt.Errorf("%w waiting for the box", sandbox.ErrTimeout))
+	select {
+	case <-time.After(MaxBurstRuntime + MaxBurstRuntime):
+		break
+	case reply := <-callChannel:
+		result = parseResult(reply)
+		break
+	}
+	if int64(len(result.Stdout)) > metadata.BurstOutput {
+		result.Stdout = result.Stdout[:metadata.BurstOutput]
+	}
+	// Bags streamed by the box are metered like the input and the output.
+	recordRun(apiKey, started, result.Usage.Cpu.Milliseconds(), len(input)+int(result.Usage.StreamedIn), len(result.Stdout)+int(result.Usage.StreamedOut))
+	return result, resultStatus(result)
+}
@@ -3,18 +3,25 @@ package burst
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"gitlab.com/eper.io/engine/billing"
 	"gitlab.com/eper.io/engine/burst/php"
+	"gitlab.com/eper.io/engine/burst/runtimes"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/burst/wasm"
 	"gitlab.com/eper.io/engine/drawing"
 	"gitlab.com/eper.io/engine/englang"
 	"gitlab.com/eper.io/engine/mesh"
 	"gitlab.com/eper.io/engine/metadata"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -83,6 +90,59 @@ func TestBurst(t *testing.T) {
 		t.Error("not expected")
 	}
 
+	lock.Lock()
+	record := BurstSession[burstSession]
+	lock.Unlock()
+	var started, took, cpu, in, out string
+	line := record[strings.LastIndex(record, "\n")+1:]
+	if nil != englang.Scanf1(line, runRecordPattern, &started, &took, &cpu, &in, &out) || englang.Decimal(in) != int64(len("Run the following php code."+php.MockPhp)) || englang.Decimal(out) != int64(len(php.MockPhpResult)) {
+		t.Error("run was not accounted", record)
+	}
+
+	job := mesh.EnglangRequest(englang.Printf("Call server http://127.0.0.1%s path /run.job?apikey=%s with method PUT and content %s. The call expects englang.", metadata.Http11Port, burstSession, "Run the following php code."+php.MockPhp))
+	if mesh.GetIndex(job) != mesh.WhoAmI {
+		t.Error("job is not indexed", job)
+	}
+	response, err := http.Get(englang.Printf("http://127.0.0.1%s/run.job?apikey=%s&wait=%s", metadata.Http11Port, job, "20"))
+	if err != nil || response.StatusCode != http.StatusOK || drawing.NoErrorString(io.ReadAll(response.Body)) != "<html><body>Hello World!</body></html>" {
+		t.Error("job did not finish", response)
+	}
+	_, status := getJob(job)
+	if status != JobDone {
+		t.Error(status)
+	}
+	CleanupExpiredJobs()
+	if burst, _ := getJob(job); burst == "" {
+		t.Error("job expired early")
+	}
+	retention := JobRetention
+	JobRetention = 0
+	CleanupExpiredJobs()
+	JobRetention = retention
+	if burst, _ := getJob(job); burst != "" || mesh.GetIndex(job) != "" {
+		t.Error("job did not expire")
+	}
+	put, _ := http.NewRequest("PUT", englang.Printf("http://127.0.0.1%s/run.job?apikey=%s", metadata.Http11Port, burstSession), strings.NewReader(strings.Repeat("x", maxJobSize+1)))
+	response, err = http.DefaultClient.Do(put)
+	if err != nil || response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("large job was accepted", response)
+	}
+	response, err = http.Get(englang.Printf("http://127.0.0.1%s/run.job?apikey=%s", metadata.Http11Port, "unknown"))
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Error("unknown job was found", response)
+	}
+	queued := drawing.GenerateUniqueKey()
+	lock.Lock()
+	BurstJobs[queued] = englang.Printf(jobPattern, burstSession, JobQueued)
+	lock.Unlock()
+	response, err = http.Get(englang.Printf("http://127.0.0.1%s/run.job?apikey=%s", metadata.Http11Port, queued))
+	deleteJob(queued)
+	if err != nil || response.StatusCode != http.StatusAccepted {
+		t.Error("queued job is not pending", response)
+	} else if reply := drawing.NoErrorString(io.ReadAll(response.Body)); reply != "Job is queued." || strings.Contains(reply, burstSession) {
+		t.Error(reply)
+	}
+
 	time.Sleep(MaxBurstRuntime)
 	if len(ContainerResults) > 0 {
 		t.Error("no cleanup")
@@ -175,6 +235,463 @@ func TestRun(t *testing.T) {
 	t.Log(s)
 }
 
+func TestSandbox(t *testing.T) {
+	work, err := sandbox.NewWork(drawing.GenerateUniqueKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(work) }()
+	drawing.NoErrorVoid(os.WriteFile(path.Join(work, "input"), []byte("Hello Sandbox!"), 0600))
+	limits := sandbox.DefaultLimits(5 * time.Second)
+
+	out, _, err := sandbox.Run(limits, work, "cat", path.Join(sandbox.WorkDir, "input"))
+	if errors.Is(err, sandbox.ErrNoSandbox) {
+		t.Skip(err)
+	}
+	if err != nil || string(out) != "Hello Sandbox!" {
+		t.Fatal(string(out), err)
+	}
+
+	out, _, _ = sandbox.Run(limits, work, "sh", "-c", "echo x > /etc/burst || echo read-only")
+	if string(out) != "read-only\n" {
+		t.Error("root is writable", string(out))
+	}
+	out, _, _ = sandbox.Run(limits, work, "sh", "-c", "echo x > /tmp/burst && cat /tmp/burst && echo x > /work/output && ls /tmp /work")
+	if string(out) != "x\n/tmp:\nburst\n\n/work:\ninput\noutput\n" {
+		t.Error("scratch is not isolated", string(out))
+	}
+	out, _, _ = sandbox.Run(limits, work, "sh", "-c", "ls "+metadata.StorageRoot+" | wc -l")
+	if string(out) != "0\n" {
+		t.Error("host files are visible", string(out))
+	}
+	out, _, _ = sandbox.Run(limits, work, "sh", "-c", "cat /proc/net/dev | grep -v lo: | wc -l")
+	if string(out) != "2\n" && string(out) != "0\n" {
+		t.Error("network is visible", string(out))
+	}
+
+	limits.Output = 1000
+	out, _, err = sandbox.Run(limits, work, "sh", "-c", "while true; do echo 0123456789; done")
+	if err != sandbox.ErrOutputLimit || len(out) != 1000 {
+		t.Error("output was not limited", len(out), err)
+	}
+	_, usage, _ := sandbox.Run(limits, work, "sh", "-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done")
+	if usage.Cpu <= 0 {
+		t.Error("cpu time was not accounted")
+	}
+
+	limits.Timeout = 500 * time.Millisecond
+	started := time.Now()
+	_, _, err = sandbox.Run(limits, work, "sleep", "10")
+	if err != sandbox.ErrTimeout || time.Now().Sub(started) > 5*time.Second {
+		t.Error("burst was not stopped", err)
+	}
+}
+
+func TestRuntimes(t *testing.T) {
+	for _, name := range runtimes.Names() {
+		runtime := runtimes.Get(name)
+		result := RunExternalShell(runtime.Prefix + runtime.Mock)
+		if string(result.Stdout) != runtime.MockResult || result.Failed() {
+			t.Error(name, string(result.Stdout))
+		}
+	}
+	if result := RunExternalShell("Run the following unknown code."); result.ExitCode != -1 || len(result.Stderr) == 0 {
+		t.Error("unknown task did not fail", string(result.Stdout))
+	}
+
+	runtimes.Register("test", &runtimes.Runtime{Prefix: "Run the following test code.", Interpreter: "/bin/sh", Extension: ".sh", Timeout: 5 * time.Second})
+	defer runtimes.Register("test", nil)
+	result, ok := runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following test code.echo $0 $((6*7))", time.Second)
+	if !ok {
+		t.Fatal("runtime not found")
+	}
+	if errors.Is(result.Err, sandbox.ErrNoSandbox) {
+		t.Skip(result.Err)
+	}
+	if !strings.HasPrefix(string(result.Stdout), sandbox.WorkDir+"/") || !strings.HasSuffix(string(result.Stdout), ".sh 42\n") {
+		t.Error(string(result.Stdout))
+	}
+	result, _ = runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following test code.echo out; echo err >&2; exit 3", time.Second)
+	if result.ExitCode != 3 || string(result.Stdout) != "out\n" || string(result.Stderr) != "err\n" || result.TimedOut {
+		t.Error(result.ExitCode, string(result.Stdout), string(result.Stderr))
+	}
+	runtimes.Get("test").Timeout = time.Second
+	result, _ = runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following test code.sleep 10", time.Second)
+	if !result.TimedOut || result.ExitCode != -1 || resultStatus(result) != JobTimedOut {
+		t.Error("burst did not time out", result.ExitCode, string(result.Stderr))
+	}
+}
+
+func TestResult(t *testing.T) {
+	result := sandbox.Result{Stdout: []byte("out\nput"), Stderr: []byte("error\n"), ExitCode: 2, Duration: 1500 * time.Millisecond, Usage: sandbox.Usage{Cpu: 20 * time.Millisecond}}
+	reply := formatResult(result)
+	if !strings.HasPrefix(reply, "Burst exited with code 2 after 1500 milliseconds using 20 cpu milliseconds. It wrote 6 bytes of standard error and 7 bytes of standard output.\n") {
+		t.Error(reply)
+	}
+	parsed := parseResult(reply)
+	if string(parsed.Stdout) != "out\nput" || string(parsed.Stderr) != "error\n" || parsed.ExitCode != 2 || parsed.Duration != result.Duration || parsed.Usage != result.Usage || parsed.TimedOut {
+		t.Error(formatResult(parsed))
+	}
+	if parsed = parseResult(reply + "x"); parsed.ExitCode != -1 || resultStatus(parsed) != JobFailed {
+		t.Error("invalid result was accepted")
+	}
+	result.Usage.StreamedIn, result.Usage.StreamedOut = 1000, 12
+	if parsed = parseResult(formatResult(result)); parsed.Usage != result.Usage || string(parsed.Stdout) != "out\nput" {
+		t.Error(formatResult(result))
+	}
+	result.Usage = sandbox.Usage{Cpu: 20 * time.Millisecond}
+
+	w := httptest.NewRecorder()
+	writeResult(w, result)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != reply || w.Header().Get(resultHeader) == "" {
+		t.Error(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	result.TimedOut = true
+	writeResult(w, result)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Error(w.Code)
+	}
+	w = httptest.NewRecorder()
+	writeResult(w, sandbox.Result{Stdout: []byte("done")})
+	if w.Code != http.StatusOK || w.Body.String() != "done" || !strings.HasPrefix(w.Header().Get(resultHeader), "Burst exited with code 0 ") {
+		t.Error(w.Code, w.Body.String())
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	burst := "TESTACCOUNTING"
+	lock.Lock()
+	BurstSession[burst] = "Burst chain api.\n" + englang.Printf(runRecordPattern, "2023-06-01 10:00:00", "5", "4", "3", "2")
+	lock.Unlock()
+	defer func() { lock.Lock(); delete(BurstSession, burst); lock.Unlock() }()
+	for i := 0; i < 3*maxRunHistory; i++ {
+		recordRun(burst, time.Now(), 1, 10, 100)
+	}
+	lock.Lock()
+	record := BurstSession[burst]
+	lock.Unlock()
+	var runs, took, cpu, in, out string
+	if strings.Count(record, "Run at ") != maxRunHistory || strings.Count(record, "Runs so far are ") != 1 {
+		t.Error(record)
+	}
+	for _, line := range strings.Split(record, "\n") {
+		if nil == englang.Scanf1(line, runTotalPattern, &runs, &took, &cpu, &in, &out) {
+			break
+		}
+	}
+	if englang.Decimal(runs) != 3*maxRunHistory+1 || englang.Decimal(cpu) != 3*maxRunHistory+4 || englang.Decimal(in) != 30*maxRunHistory+3 || englang.Decimal(out) != 300*maxRunHistory+2 {
+		t.Error(record)
+	}
+}
+
+func TestWasm(t *testing.T) {
+	types := wasmSection(1, wasmVector([]byte{0x60, 4, 0x7F, 0x7F, 0x7F, 0x7F, 1, 0x7F}, []byte{0x60, 0, 0}))
+	exports := wasmSection(7, wasmVector(append(wasmString("_start"), 0, 2)))
+	memory := wasmSection(5, wasmVector([]byte{0, 1}))
+	hello := wasmModule(types,
+		wasmSection(2, wasmVector(wasmImport("fd_write"))),
+		wasmSection(3, wasmVector([]byte{1})),
+		memory,
+		wasmSection(7, wasmVector(append(wasmString("_start"), 0, 1))),
+		wasmSection(10, wasmVector(wasmString(string([]byte{0, 0x41, 1, 0x41, 0, 0x41, 1, 0x41, 20, 0x10, 0, 0x1A, 0x0B})))),
+		wasmSection(11, wasmVector(append([]byte{0, 0x41, 0, 0x0B}, wasmString("\x08\x00\x00\x00\x0d\x00\x00\x00Hello World!\n")...))))
+	result := RunExternalShell(string(hello))
+	if string(result.Stdout) != "Hello World!\n" || result.Failed() {
+		t.Error(string(result.Stdout))
+	}
+
+	// Uppercase the standard input
+	upper := wasmModule(types,
+		wasmSection(2, wasmVector(wasmImport("fd_read"), wasmImport("fd_write"))),
+		wasmSection(3, wasmVector([]byte{1})),
+		memory,
+		exports,
+		wasmSection(10, wasmVector(wasmString(string([]byte{1, 3, 0x7F,
+			0x41, 0, 0x41, 0, 0x41, 1, 0x41, 16, 0x10, 0, 0x1A,
+			0x41, 0, 0x28, 2, 16, 0x21, 0,
+			0x02, 0x40, 0x03, 0x40,
+			0x20, 1, 0x20, 0, 0x4F, 0x0D, 1,
+			0x20, 1, 0x2D, 0, 64, 0x21, 2,
+			0x20, 2, 0x41, 0xE1, 0, 0x6B, 0x41, 26, 0x49,
+			0x04, 0x40, 0x20, 1, 0x20, 2, 0x41, 32, 0x6B, 0x3A, 0, 64, 0x0B,
+			0x20, 1, 0x41, 1, 0x6A, 0x21, 1,
+			0x0C, 0, 0x0B, 0x0B,
+			0x41, 0, 0x20, 0, 0x36, 2, 4,
+			0x41, 1, 0x41, 0, 0x41, 1, 0x41, 16, 0x10, 1, 0x1A, 0x0B})))),
+		wasmSection(11, wasmVector(append([]byte{0, 0x41, 0, 0x0B}, wasmString("\x40\x00\x00\x00\x00\x04\x00\x00")...))))
+	out, usage, err := wasm.Run(upper, []byte("Hello Wasm!"), sandbox.DefaultLimits(time.Second))
+	if err != nil || string(out) != "HELLO WASM!" || usage.Cpu <= 0 {
+		t.Error(string(out), err)
+	}
+	bags := newTestBags(map[string]string{"MODULE": string(upper), "INPUT": "hello stream"})
+	defer bags.Close()
+	result, _ = runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following wasm module.MODULE\nhello bag", time.Second)
+	if string(result.Stdout) != "HELLO BAG" {
+		t.Error(string(result.Stdout))
+	}
+	result = RunExternalShell("Run with input bag INPUT and write output to bag OUTPUT.\n" +
+		"Run the following wasm module.MODULE")
+	if result.Failed() || len(result.Stdout) != 0 || bags.get("OUTPUT") != "HELLO STREAM" || result.Usage.StreamedIn != 12 || result.Usage.StreamedOut != 12 {
+		t.Error(bags.get("OUTPUT"), string(result.Stderr), result.Usage)
+	}
+	result, _ = runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following wasm module."+bags.URL+"/tmp?apikey=MODULE\nhello bag", time.Second)
+	if !errors.Is(result.Err, wasm.ErrNotBag) {
+		t.Error("module was loaded from a url")
+	}
+	module := metadata.BurstModule
+	metadata.BurstModule = int64(len(upper) - 1)
+	result, _ = runtimes.RunTask(drawing.GenerateUniqueKey(), "Run the following wasm module.MODULE\nhello bag", time.Second)
+	metadata.BurstModule = module
+	if !result.Failed() {
+		t.Error("module size was not limited")
+	}
+
+	exit := wasmModule(wasmSection(1, wasmVector([]byte{0x60, 1, 0x7F, 0}, []byte{0x60, 0, 0})),
+		wasmSection(2, wasmVector(append(append(wasmString("wasi_snapshot_preview1"), wasmString("proc_exit")...), 0, 0))),
+		wasmSection(3, wasmVector([]byte{1})),
+		wasmSection(7, wasmVector(append(wasmString("_start"), 0, 1))),
+		wasmSection(10, wasmVector(wasmString(string([]byte{0, 0x41, 7, 0x10, 0, 0x0B})))))
+	result = wasm.Execute(exit, nil, sandbox.DefaultLimits(time.Second))
+	if result.ExitCode != 7 || result.Err == nil || result.TimedOut {
+		t.Error("exit code was not returned", result.ExitCode, result.Err)
+	}
+
+	loop := wasmModule(types, wasmSection(3, wasmVector([]byte{1})), wasmSection(7, wasmVector(append(wasmString("_start"), 0, 0))),
+		wasmSection(10, wasmVector(wasmString(string([]byte{0, 0x03, 0x40, 0x0C, 0, 0x0B, 0x0B})))))
+	fuel := metadata.BurstFuel
+	metadata.BurstFuel = 100000
+	defer func() { metadata.BurstFuel = fuel }()
+	result = wasm.Execute(loop, nil, sandbox.DefaultLimits(time.Second))
+	if result.Err != wasm.ErrOutOfFuel || result.ExitCode != -1 || !strings.HasSuffix(string(result.Stderr), wasm.ErrOutOfFuel.Error()+"\n") {
+		t.Error("fuel was not limited", result.Err)
+	}
+	_, _, err = wasm.Run(append(loop[:len(loop)-1:len(loop)-1], 0), nil, sandbox.DefaultLimits(time.Second))
+	if err == nil {
+		t.Error("malformed module ran")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	input, output, task, ok := parseStreams("Run with input bag ABC and write output to bag DEF.\nRun the following shell code.wc -c")
+	if !ok || input != "ABC" || output != "DEF" || task != "Run the following shell code.wc -c" {
+		t.Error(input, output, task)
+	}
+	input, output, _, ok = parseStreams("Run with input bag ABC.\nRun the following shell code.wc -c")
+	if !ok || input != "ABC" || output != "" {
+		t.Error(input, output)
+	}
+	input, output, _, ok = parseStreams("Run and write output to bag DEF.\nRun the following shell code.ls")
+	if !ok || input != "" || output != "DEF" {
+		t.Error(input, output)
+	}
+	if _, _, _, ok = parseStreams("Run the following shell code.ls"); ok {
+		t.Error("task without bags was parsed")
+	}
+
+	bags := newTestBags(map[string]string{"OUTPUT": "previous"})
+	defer bags.Close()
+	result := RunExternalShell("Run and write output to bag OUTPUT.\nRun the following php code." + php.MockPhp)
+	if result.Failed() || len(result.Stdout) != 0 || bags.get("OUTPUT") != php.MockPhpResult {
+		t.Error(bags.get("OUTPUT"), string(result.Stderr))
+	}
+	result = RunExternalShell("Run with input bag MISSING and write output to bag OUTPUT.\nRun the following php code." + php.MockPhp)
+	if !result.Failed() || bags.get("OUTPUT") != php.MockPhpResult {
+		t.Error("missing input bag was not reported")
+	}
+	result = RunExternalShell("Run and write output to bag " + bags.URL + "/tmp?apikey=OUTPUT.\nRun the following php code." + php.MockPhp)
+	if !errors.Is(result.Err, wasm.ErrNotBag) {
+		t.Error("output was written to a url")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	steps, err := parsePipeline("Step extract runs the following.\nRun the following shell code.echo hello\necho world\n" +
+		"Step upper after extract runs the following.\nRun the following wasm module.ABC\n" +
+		"Step count after extract runs the following.\nRun the following shell code.wc -w\n" +
+		"Step join after upper, count runs the following.\nRun the following shell code.cat")
+	if err != nil || len(steps) != 4 || steps[0].task != "Run the following shell code.echo hello\necho world" || len(steps[3].after) != 2 {
+		t.Fatal(steps, err)
+	}
+	statuses := map[string]string{"extract": JobDone, "upper": JobDone, "count": JobQueued}
+	if !stepReady(steps[1], statuses) || stepReady(steps[3], statuses) {
+		t.Error("steps are not ready in order")
+	}
+	statuses["count"] = JobDone
+	input, skipped := stepInput(steps[3], map[string]string{"upper": "HELLO\n", "count": "2\n"}, statuses)
+	if skipped || input != "Run the following shell code.cat\nHELLO\n2\n" {
+		t.Error(input)
+	}
+	input, _ = stepInput(steps[3], map[string]string{"upper": "HELLO", "count": "2"}, statuses)
+	if input != "Run the following shell code.cat\nHELLO\n2" {
+		t.Error(input)
+	}
+	statuses["count"] = JobFailed
+	_, skipped = stepInput(steps[3], map[string]string{}, statuses)
+	if !skipped {
+		t.Error("step after a failed step was not skipped")
+	}
+
+	for _, invalid := range []string{"", "echo hello\nStep a runs the following.",
+		"Step a after b runs the following.\nStep b runs the following.",
+		"Step a runs the following.\nStep a runs the following.", "Step a b runs the following."} {
+		_, err = parsePipeline(invalid)
+		if err == nil {
+			t.Error("invalid pipeline was parsed", invalid)
+		}
+	}
+
+	burst := "TESTPIPELINECLEANUP"
+	lock.Lock()
+	BurstSession[burst] = "Burst chain api."
+	lock.Unlock()
+	defer func() { lock.Lock(); delete(BurstSession, burst); lock.Unlock() }()
+	setStepStatus(burst, "OLD", "extract", JobDone)
+	setSessionLine(burst, "Pipeline OLD finished at ", englang.Printf(pipelineFinishedPattern, "OLD", time.Now().Add(-2*JobRetention).UTC().Format("2006-01-02 15:04:05")))
+	setStepStatus(burst, "NEW", "extract", JobDone)
+	setSessionLine(burst, "Pipeline NEW finished at ", englang.Printf(pipelineFinishedPattern, "NEW", time.Now().UTC().Format("2006-01-02 15:04:05")))
+	setStepStatus(burst, "RUNNING", "extract", JobRunning)
+	CleanupExpiredPipelines(burst)
+	lock.Lock()
+	record := BurstSession[burst]
+	lock.Unlock()
+	if strings.Contains(record, "Pipeline OLD ") || !strings.Contains(record, "Pipeline NEW step extract is done.") || !strings.Contains(record, "Pipeline RUNNING step") {
+		t.Error(record)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	for schedule, expected := range map[string]string{
+		"Run this every day at 02:00 UTC.":    "0 2 * * *",
+		"Run this every monday at 02:30 UTC.": "30 2 * * 1",
+		"Run this every hour at 15 minutes.":  "15 * * * *",
+		"Run this every 10 minutes.":          "*/10 * * * *",
+		"Run this at cron 0 2 * * 1-5.":       "0 2 * * 1-5",
+	} {
+		cron, err := parseSchedule(schedule)
+		if err != nil || cron != expected {
+			t.Error(schedule, cron, err)
+		}
+	}
+	for _, invalid := range []string{"Run this every day at 25:00 UTC.", "Run this every someday at 02:00 UTC.", "Run this every 0 minutes.", "Run this every 90 minutes.", "Run this every 7 minutes.", "Run this at cron 0 2 * *.", "Run this at cron 60 * * * *.", "Run this daily."} {
+		_, err := parseSchedule(invalid)
+		if err == nil {
+			t.Error("invalid schedule was parsed", invalid)
+		}
+	}
+
+	monday := time.Date(2023, 6, 5, 2, 0, 0, 0, time.UTC)
+	if !cronMatches("0 2 * * *", monday) || cronMatches("0 2 * * *", monday.Add(time.Minute)) ||
+		!cronMatches("*/10 * * * *", monday.Add(20*time.Minute)) || cronMatches("*/10 * * * *", monday.Add(25*time.Minute)) ||
+		!cronMatches("0 2 * * 1-5", monday) || cronMatches("0 2 * * 0,6", monday) || !cronMatches("0 2 * * 7", monday.Add(-24*time.Hour)) ||
+		!cronMatches("0 2 5 * 0", monday) || cronMatches("0 2 6 * 0", monday) {
+		t.Error("cron does not match")
+	}
+
+	lock.Lock()
+	BurstSession["schedule"] = "Burst session for testing."
+	lock.Unlock()
+	defer func() { lock.Lock(); delete(BurstSession, "schedule"); lock.Unlock() }()
+	id := addSchedule("schedule", "0 2 * * *", "Run the following shell code.echo refresh")
+	for i := 0; i < maxScheduleHistory+2; i++ {
+		recordScheduledRun("schedule", id, monday, JobDone, 8)
+	}
+	lock.Lock()
+	record := BurstSession["schedule"]
+	lock.Unlock()
+	if !strings.Contains(record, englang.Printf("Schedule %s runs at 0 2 * * * UTC.", id)) || strings.Count(record, " ran at ") != maxScheduleHistory {
+		t.Error(record)
+	}
+	deleteSchedule(id)
+	lock.Lock()
+	record = BurstSession["schedule"]
+	lock.Unlock()
+	if strings.Contains(record, id) || len(BurstSchedules) != 0 {
+		t.Error("schedule was not deleted", record)
+	}
+
+	backup := bytes.Buffer{}
+	writer := bufio.NewWriter(&backup)
+	LogSnapshot("GET", writer, nil)
+	_ = writer.Flush()
+	mesh.DeleteIndex("schedule")
+	LogSnapshot("PUT", nil, bufio.NewReader(&backup))
+	defer mesh.DeleteIndex("schedule")
+	if !mesh.CheckExpiry("schedule") || mesh.GetIndex("schedule") != mesh.WhoAmI {
+		t.Error("restored session does not run its schedules")
+	}
+}
+
+// testBags serves bags by their api key.
+type testBags struct {
+	*httptest.Server
+	lock  sync.Mutex
+	files map[string]string
+	port  string
+}
+
+// newTestBags serves bags on the port of this node, until it is closed.
+func newTestBags(files map[string]string) *testBags {
+	bags := &testBags{files: files, port: metadata.Http11Port}
+	bags.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.URL.Query().Get("apikey")
+		bags.lock.Lock()
+		defer bags.lock.Unlock()
+		if r.Method == "PUT" {
+			bags.files[apiKey] = drawing.NoErrorString(io.ReadAll(r.Body))
+			return
+		}
+		content, ok := bags.files[apiKey]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	metadata.Http11Port = strings.TrimPrefix(bags.URL, "http://127.0.0.1")
+	return bags
+}
+
+func (bags *testBags) Close() {
+	metadata.Http11Port = bags.port
+	bags.Server.Close()
+}
+
+func (bags *testBags) get(apiKey string) string {
+	bags.lock.Lock()
+	defer bags.lock.Unlock()
+	return bags.files[apiKey]
+}
+
+func wasmModule(sections ...[]byte) []byte {
+	return append([]byte(wasm.Magic+"\x01\x00\x00\x00"), bytes.Join(sections, nil)...)
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	return append(append([]byte{id}, uleb(len(content))...), content...)
+}
+
+func wasmVector(items ...[]byte) []byte {
+	return append(uleb(len(items)), bytes.Join(items, nil)...)
+}
+
+func wasmString(s string) []byte {
+	return append(uleb(len(s)), s...)
+}
+
+func wasmImport(name string) []byte {
+	return append(append(wasmString("wasi_snapshot_preview1"), wasmString(name)...), 0, 0)
+}
+
+func uleb(n int) []byte {
+	ret := make([]byte, 0)
+	for n >= 0x80 {
+		ret = append(ret, byte(n&0x7F|0x80))
+		n = n >> 7
+	}
+	return append(ret, byte(n))
+}
+
 func DummyBroker() {
 	go func() {
 		// Broker
@@ -1,11 +1,15 @@
 package burst
 
 import (
-	"gitlab.com/eper.io/engine/burst/php"
+	"errors"
+	_ "gitlab.com/eper.io/engine/burst/php"
+	"gitlab.com/eper.io/engine/burst/runtimes"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/burst/wasm"
 	"gitlab.com/eper.io/engine/drawing"
 	"gitlab.com/eper.io/engine/englang"
 	"gitlab.com/eper.io/engine/metadata"
-	"os/exec"
+	"os"
 	"strings"
 	"time"
 )
@@ -19,40 +23,52 @@ import (
 
 // This is a module code that runs burst containers.
 // The big difference between these and other modules is that bursts do not have an api endpoint.
+// Commands and code of the runtimes run in the sandbox with the limits of metadata, never in the box process.
 
-func RunExternalShell(task string) string {
-	var ret string
+// RunExternalShell runs a task, and it returns the result with the resources used for accounting.
+func RunExternalShell(task string) sandbox.Result {
 	if task == "Idle." {
-		return "Idle."
+		return sandbox.Result{Stdout: []byte("Idle.")}
 	}
-	ret = php.EnglangPhp(drawing.GenerateUniqueKey(), task, MaxBurstRuntime+500*time.Millisecond)
-	if ret != "" {
-		return ret
+	input, output, rest, ok := parseStreams(task)
+	if ok {
+		return runWithStreams(input, output, rest)
 	}
-	task = runCommandInBox(task)
-	if ret != "" {
-		return ret
+	return runTask(task, sandbox.Streams{})
+}
+
+func runTask(task string, streams sandbox.Streams) sandbox.Result {
+	if strings.HasPrefix(task, wasm.Magic) {
+		// Compiled modules are sent as they are.
+		task = "Run the following wasm code." + task
+	}
+	result, ok := runtimes.RunTaskStreams(drawing.GenerateUniqueKey(), task, MaxBurstRuntime+500*time.Millisecond, streams)
+	if ok {
+		return result
+	}
+	result, ok = runCommandInBox(task, streams)
+	if ok {
+		return result
 	}
-	return "This is the result." + task
+	return sandbox.Failure(errors.New("burst is not a command line or code of a runtime"))
 }
 
-func runCommandInBox(task string) string {
+func runCommandInBox(task string, streams sandbox.Streams) (sandbox.Result, bool) {
 	var command string
-	if nil == englang.Scanf1(task+"DZPSOTHXAYZMZSJQEFMAD", "Run the following command line.%s"+"DZPSOTHXAYZMZSJQEFMAD", &command) {
-		cmds := strings.Split(command, "")
-		cmd := exec.Command(cmds[0], cmds[1:]...)
-		go func() {
-			if !metadata.Simplify {
-				time.Sleep(MaxBurstRuntime + 500*time.Millisecond)
-				if cmd.Process != nil {
-					_ = cmd.Process.Kill()
-				}
-			}
-		}()
-		ret, _ := cmd.Output()
-		task = string(ret)
-	}
-	return task
+	if nil != englang.Scanf1(task+"DZPSOTHXAYZMZSJQEFMAD", "Run the following command line.%s"+"DZPSOTHXAYZMZSJQEFMAD", &command) {
+		return sandbox.Result{}, false
+	}
+	cmds := strings.Split(command, " ")
+	work, err := sandbox.NewWork(drawing.GenerateUniqueKey())
+	if err != nil {
+		return sandbox.Failure(err), true
+	}
+	defer func() { _ = os.RemoveAll(work) }()
+	limits := sandbox.DefaultLimits(MaxBurstRuntime + 500*time.Millisecond)
+	if streams.Stdout != nil {
+		limits.Output = metadata.BagQuota
+	}
+	return sandbox.ExecuteStreams(limits, work, streams, cmds...), true
 }
 
 func FinishCleanup() {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
 	"sync"
 	"time"
 )
@@ -44,15 +45,22 @@ func LogSnapshot(m string, w *bufio.Writer, r *bufio.Reader) {
 		for k, v := range BurstSession {
 			englang.WriteIndexedEntry(w, k, "burst", bytes.NewBufferString(v))
 		}
+		for k, v := range BurstSchedules {
+			englang.WriteIndexedEntry(w, k, "schedule", bytes.NewBufferString(v))
+		}
 	}
 	if m == "PUT" {
 		for {
-			e, k, v := englang.ReadIndexedEntry(*r)
+			e, k, v := englang.ReadIndexedEntry(r)
 			if k == "" {
 				return
 			}
 			if e == "burst" {
 				BurstSession[k] = v
+				mesh.RestoreExpiry(k, v, ValidPeriod)
+			}
+			if e == "schedule" {
+				BurstSchedules[k] = v
 			}
 		}
 	}
@@ -0,0 +1,187 @@
+package burst
+
+import (
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"io"
+	"net/http"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bursts can run asynchronously as jobs, so that clients do not keep a request open for the whole run.
+// The job id is registered in the mesh index, so any node can be polled for it behind a load balancer.
+// curl -X PUT -d 'Run the following wasm code....' 'https://example.com/run.job?apikey=<burst>' returns a job id.
+// curl -X GET 'https://example.com/run.job?apikey=<job>' returns the result, or the status with 202, if it is not finished.
+// curl -X GET 'https://example.com/run.job?apikey=<job>&wait=30' waits up to 30 seconds for the job to finish.
+// curl -X DELETE 'https://example.com/run.job?apikey=<job>' forgets the job and its result.
+// Job is running.
+// Jobs are queued, running, done, failed, or timed-out.
+// Jobs wait for an idle box up to JobQueueTime, and finished jobs are kept for JobRetention.
+// Jobs have an input of up to 1 MiB like pipelines.
+
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobTimedOut = "timed-out"
+)
+
+const jobPattern = "Job of burst %s is %s."
+
+// jobStatusPattern is the reply of unfinished jobs. It does not tell the burst key, because the job id can be shared.
+const jobStatusPattern = "Job is %s."
+
+var JobQueueTime = time.Minute
+var JobRetention = time.Hour
+
+const maxJobWait = 60 * time.Second
+
+const maxJobSize = 1024 * 1024
+
+var BurstJobs = map[string]string{}
+var jobResults = map[string]sandbox.Result{}
+var jobFinished = map[string]time.Time{}
+
+func setupJobs() {
+	http.HandleFunc("/run.job", func(w http.ResponseWriter, r *http.Request) {
+		if nil == mesh.RedirectToPeerServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		if r.Method == "PUT" {
+			lock.Lock()
+			_, call := BurstSession[apiKey]
+			lock.Unlock()
+			if !call {
+				management.QuantumGradeAuthorization()
+				w.WriteHeader(http.StatusPaymentRequired)
+				drawing.NoErrorWrite(w.Write([]byte("Payment required with a PUT to /run.coin")))
+				return
+			}
+			input := drawing.NoErrorString(io.ReadAll(io.LimitReader(r.Body, maxJobSize+1)))
+			if len(input) > maxJobSize {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(startJob(apiKey, input)))
+			return
+		}
+		burst, status := getJob(apiKey)
+		if burst == "" {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			wait := time.Duration(englang.Decimal(r.URL.Query().Get("wait"))) * time.Second
+			if wait > maxJobWait {
+				wait = maxJobWait
+			}
+			status = waitForJob(apiKey, wait)
+			lock.Lock()
+			result := jobResults[apiKey]
+			lock.Unlock()
+			if status == JobQueued || status == JobRunning {
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte(englang.Printf(jobStatusPattern, status)))
+				return
+			}
+			writeResult(w, result)
+			return
+		}
+		if r.Method == "DELETE" {
+			deleteJob(apiKey)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+// startJob queues the input of a burst, and it returns the job id right away.
+func startJob(burst string, input string) string {
+	job := drawing.GenerateUniqueKey()
+	lock.Lock()
+	BurstJobs[job] = englang.Printf(jobPattern, burst, JobQueued)
+	lock.Unlock()
+	mesh.RegisterIndex(job)
+	go func() {
+		result, status := runBurst(burst, input, JobQueueTime, func() { setJobStatus(job, JobRunning) })
+		lock.Lock()
+		_, ok := BurstJobs[job]
+		if ok {
+			jobResults[job] = result
+			jobFinished[job] = time.Now()
+		}
+		lock.Unlock()
+		setJobStatus(job, status)
+	}()
+	return job
+}
+
+func getJob(job string) (string, string) {
+	lock.Lock()
+	defer lock.Unlock()
+	var burst, status string
+	if nil != englang.Scanf1(BurstJobs[job], jobPattern, &burst, &status) {
+		return "", ""
+	}
+	return burst, status
+}
+
+func setJobStatus(job string, status string) {
+	burst, _ := getJob(job)
+	if burst == "" {
+		return
+	}
+	lock.Lock()
+	BurstJobs[job] = englang.Printf(jobPattern, burst, status)
+	lock.Unlock()
+}
+
+// waitForJob returns the status of a job, when it is finished, or when the time is up.
+func waitForJob(job string, wait time.Duration) string {
+	deadline := time.Now().Add(wait)
+	for {
+		_, status := getJob(job)
+		if status != JobQueued && status != JobRunning || !time.Now().Before(deadline) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func deleteJob(job string) {
+	lock.Lock()
+	delete(BurstJobs, job)
+	delete(jobResults, job)
+	delete(jobFinished, job)
+	lock.Unlock()
+	mesh.DeleteIndex(job)
+}
+
+// CleanupExpiredJobs deletes the jobs that finished longer than JobRetention ago.
+func CleanupExpiredJobs() {
+	lock.Lock()
+	expired := make([]string, 0)
+	for job, finished := range jobFinished {
+		if time.Now().Sub(finished) > JobRetention {
+			expired = append(expired, job)
+		}
+	}
+	lock.Unlock()
+	for _, job := range expired {
+		deleteJob(job)
+	}
+}
@@ -0,0 +1,103 @@
+package burst
+
+import (
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"net/http"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Burst session owners can be warned before the session expires, and when it is deleted.
+// curl -X PUT -d 'https://example.com/hook' 'https://example.com/run.notify?apikey=<burst>&hours=48'
+// curl -X PUT -d 'ops@example.com' 'https://example.com/run.notify?apikey=<burst>'
+// curl -X GET 'https://example.com/run.notify?apikey=<burst>'
+// curl -X DELETE 'https://example.com/run.notify?apikey=<burst>'
+// Sessions keep their expiry in their record, so that restored sessions are not deleted before they expire.
+
+func setupNotifications() {
+	http.HandleFunc("/run.notify", func(w http.ResponseWriter, r *http.Request) {
+		if nil == mesh.RedirectToPeerServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		lock.Lock()
+		record, ok := BurstSession[apiKey]
+		lock.Unlock()
+		if !ok {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mesh.ServeNotification(w, r, record, ValidPeriod, func(prefix string, line string) {
+			setSessionLine(apiKey, prefix, line)
+		})
+	})
+
+	go func() {
+		for {
+			time.Sleep(metadata.CheckpointPeriod)
+			lock.Lock()
+			sessions := make([]string, 0)
+			for burst := range BurstSession {
+				sessions = append(sessions, burst)
+			}
+			lock.Unlock()
+			for _, burst := range sessions {
+				WarnExpiringSession(burst)
+				CleanupExpiredPipelines(burst)
+				CleanupExpiredSession(burst)
+			}
+			CleanupExpiredJobs()
+		}
+	}()
+}
+
+// WarnExpiringSession notifies the owner once, if the burst session expires within the requested period.
+func WarnExpiringSession(burst string) {
+	lock.Lock()
+	target, expires, due := mesh.ExpiryWarningDue(burst, BurstSession[burst])
+	lock.Unlock()
+	if !due {
+		return
+	}
+	setSessionLine(burst, mesh.ExpiryWarningSent, mesh.ExpiryWarningSent)
+	mesh.NotifyOwner(target, englang.Printf("Burst session %s expires on %s.", drawing.RedactPublicKey(burst), expires.Format("Jan 2, 2006")))
+}
+
+// CleanupExpiredSession deletes sessions that are not in the index. Restored sessions are indexed again by LogSnapshot.
+func CleanupExpiredSession(burst string) {
+	if mesh.GetIndex(burst) != "" {
+		return
+	}
+	lock.Lock()
+	record, ok := BurstSession[burst]
+	delete(BurstSession, burst)
+	lock.Unlock()
+	if !ok {
+		return
+	}
+	target, _, _ := mesh.GetNotification(record)
+	if target != "" {
+		mesh.NotifyOwner(target, englang.Printf("Burst session %s expired and it was deleted on %s.", drawing.RedactPublicKey(burst), time.Now().Format("Jan 2, 2006")))
+	}
+}
+
+func setSessionLine(burst string, prefix string, line string) {
+	lock.Lock()
+	defer lock.Unlock()
+	record, ok := BurstSession[burst]
+	if !ok {
+		return
+	}
+	BurstSession[burst] = mesh.SetRecordLine(record, prefix, line)
+}
@@ -1,10 +1,8 @@
 package php
 
 import (
-	"os"
-	"os/exec"
-	"path"
-	"strings"
+	"gitlab.com/eper.io/engine/burst/runtimes"
+	"gitlab.com/eper.io/engine/burst/sandbox"
 	"time"
 )
 
@@ -15,40 +13,26 @@ import (
 // You should have received a copy of the CC0 Public Domain Dedication along with this document.
 // If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
 
-func IsPhpAvailable() bool {
-	_, err := os.Stat(PhpPath)
-	return err == nil
-}
+// Php is a burst runtime. Change runtimes.Get("php") after startup to use another interpreter.
 
-func EnglangPhp(key string, code string, timeout time.Duration) string {
-	if strings.HasPrefix(code, "Run the following php code.") {
-		php := code[len("Run the following php code."):]
-		if php == MockPhp {
-			return MockPhpResult
-		}
-		return englangPhp(key, php, timeout)
-	}
-	return ""
+func init() {
+	runtimes.Register("php", &runtimes.Runtime{
+		Prefix:      "Run the following php code.",
+		Interpreter: PhpPath,
+		Mock:        MockPhp,
+		MockResult:  MockPhpResult,
+	})
 }
 
-func englangPhp(key string, code string, timeout time.Duration) string {
-	php := path.Join("/tmp", key)
-
-	_ = os.WriteFile(php, []byte(code), 0700)
+func IsPhpAvailable() bool {
+	return runtimes.Get("php").IsAvailable()
+}
 
-	cmd := exec.Command(PhpPath, php)
-	output, err := cmd.Output()
-	if err != nil {
-		output = []byte(err.Error())
-	} else {
-		go func() {
-			time.Sleep(timeout)
-			_ = cmd.Process.Kill()
-		}()
+func EnglangPhp(key string, code string, timeout time.Duration) sandbox.Result {
+	name, _, _ := runtimes.Find(code)
+	if name != "php" {
+		return sandbox.Result{}
 	}
-	if len(output) == 0 {
-		return "No php result returned."
-	}
-
-	return string(output)
+	result, _ := runtimes.RunTask(key, code, timeout)
+	return result
 }
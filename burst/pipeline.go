@@ -0,0 +1,266 @@
+package burst
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/burst/wasm"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Pipelines chain bursts. Each step is a burst that gets the task following its step line.
+// Steps run, when the steps they come after are done. Their outputs are appended to the task each on new lines.
+// Several steps can come after the same step to fan out, and a step can come after several steps to fan in.
+// A step can only come after steps above it, so that pipelines have no cycles.
+// Step extract runs the following.
+// Run the following shell code.echo hello world
+// Step upper after extract runs the following.
+// Run the following wasm module.<bag with upper.wasm>
+// Step join after extract, upper runs the following.
+// Run the following shell code.cat
+//
+// curl -X PUT --data-binary @pipeline.txt 'https://example.com/run.pipeline?apikey=<burst>&bag=<bag>' returns the pipeline id.
+// The output of each step is stored in the bag of the caller as a named object. Failed steps store their result with the standard error.
+// The bag is bought and its quota is used as usual. Outputs of a previous pipeline with the same step names are replaced.
+// curl -X GET 'https://example.com/tmp?apikey=<bag>&name=upper'
+// The status of each step is a line of the burst session.
+// curl -X GET 'https://example.com/run.coin?apikey=<burst>'
+// Pipeline <pipeline> step upper is done.
+// Steps are queued, running, done, failed, timed-out, or skipped, if a step before them did not finish.
+// Pipeline <pipeline> finished at 2023-06-01 10:00:00.
+// Finished pipelines are removed from the session after JobRetention like jobs.
+
+const StepSkipped = "skipped"
+
+const maxPipelineSteps = 100
+
+const maxPipelineSize = 1024 * 1024
+
+const pipelineFinishedPattern = "Pipeline %s finished at %s."
+
+type step struct {
+	name  string
+	after []string
+	task  string
+}
+
+type stepResult struct {
+	name   string
+	output string
+	status string
+}
+
+func setupPipelines() {
+	http.HandleFunc("/run.pipeline", func(w http.ResponseWriter, r *http.Request) {
+		if nil == mesh.RedirectToPeerServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		lock.Lock()
+		_, call := BurstSession[apiKey]
+		lock.Unlock()
+		if !call {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusPaymentRequired)
+			drawing.NoErrorWrite(w.Write([]byte("Payment required with a PUT to /run.coin")))
+			return
+		}
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		output := r.URL.Query().Get("bag")
+		_, err := wasm.BagUrl(output)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Pipelines need a bag for their outputs."))
+			return
+		}
+		steps, err := parsePipeline(drawing.NoErrorString(io.ReadAll(io.LimitReader(r.Body, maxPipelineSize))))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		pipeline := drawing.GenerateUniqueKey()
+		for _, s := range steps {
+			setStepStatus(apiKey, pipeline, s.name, JobQueued)
+		}
+		go runPipeline(apiKey, pipeline, output, steps)
+		management.QuantumGradeAuthorization()
+		_, _ = w.Write([]byte(pipeline))
+	})
+}
+
+// parsePipeline reads the steps of a pipeline definition.
+func parsePipeline(definition string) ([]step, error) {
+	steps := make([]step, 0)
+	defined := map[string]bool{}
+	for _, line := range strings.Split(definition, "\n") {
+		var name, after string
+		if nil == englang.Scanf1(line, "Step %s after %s runs the following.", &name, &after) ||
+			nil == englang.Scanf1(line, "Step %s runs the following.", &name) {
+			if !isValidStepName(name) || defined[name] {
+				return nil, fmt.Errorf("step %s is not valid", name)
+			}
+			s := step{name: name}
+			for _, before := range strings.Split(after, ",") {
+				before = strings.TrimSpace(before)
+				if before == "" {
+					continue
+				}
+				if !defined[before] {
+					return nil, fmt.Errorf("step %s comes after %s that is not above it", name, before)
+				}
+				s.after = append(s.after, before)
+			}
+			defined[name] = true
+			steps = append(steps, s)
+			continue
+		}
+		if len(steps) == 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			return nil, errors.New("pipeline does not start with a step")
+		}
+		current := &steps[len(steps)-1]
+		if current.task != "" {
+			current.task = current.task + "\n"
+		}
+		current.task = current.task + line
+	}
+	if len(steps) == 0 || len(steps) > maxPipelineSteps {
+		return nil, fmt.Errorf("pipelines have 1 to %d steps", maxPipelineSteps)
+	}
+	return steps, nil
+}
+
+func isValidStepName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// runPipeline starts each step, when the steps it comes after are finished, until all steps are finished.
+func runPipeline(burst string, pipeline string, outputBag string, steps []step) {
+	outputs := map[string]string{}
+	statuses := map[string]string{}
+	results := make(chan stepResult)
+	running := 0
+	for len(statuses) < len(steps) {
+		for _, s := range steps {
+			if statuses[s.name] != "" || !stepReady(s, statuses) {
+				continue
+			}
+			input, skipped := stepInput(s, outputs, statuses)
+			if skipped {
+				statuses[s.name] = StepSkipped
+				setStepStatus(burst, pipeline, s.name, StepSkipped)
+				continue
+			}
+			statuses[s.name] = JobQueued
+			running++
+			go func(s step, input string) {
+				result, status := runBurst(burst, input, JobQueueTime, func() { setStepStatus(burst, pipeline, s.name, JobRunning) })
+				output := string(result.Stdout)
+				if status != JobDone {
+					output = formatResult(result)
+				}
+				results <- stepResult{name: s.name, output: output, status: status}
+			}(s, input)
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		if storeStepOutput(outputBag, result.name, result.output) != nil && result.status == JobDone {
+			result.status = JobFailed
+		}
+		outputs[result.name] = result.output
+		statuses[result.name] = result.status
+		setStepStatus(burst, pipeline, result.name, result.status)
+	}
+	setSessionLine(burst, englang.Printf("Pipeline %s finished at ", pipeline), englang.Printf(pipelineFinishedPattern, pipeline, time.Now().UTC().Format("2006-01-02 15:04:05")))
+}
+
+// CleanupExpiredPipelines removes the lines of pipelines that finished longer than JobRetention ago.
+func CleanupExpiredPipelines(burst string) {
+	lock.Lock()
+	record := BurstSession[burst]
+	lock.Unlock()
+	for _, line := range strings.Split(record, "\n") {
+		var pipeline, at string
+		if nil != englang.Scanf1(line, pipelineFinishedPattern, &pipeline, &at) {
+			continue
+		}
+		finished, err := time.Parse("2006-01-02 15:04:05", at)
+		if err == nil && time.Now().Sub(finished) > JobRetention {
+			setSessionLine(burst, englang.Printf("Pipeline %s ", pipeline), "")
+		}
+	}
+}
+
+func stepReady(s step, statuses map[string]string) bool {
+	for _, before := range s.after {
+		if statuses[before] == "" || statuses[before] == JobQueued {
+			return false
+		}
+	}
+	return true
+}
+
+// stepInput is the task of the step followed by the outputs of the steps before it.
+func stepInput(s step, outputs map[string]string, statuses map[string]string) (string, bool) {
+	input := s.task
+	if len(s.after) > 0 {
+		input = input + "\n"
+	}
+	for i, before := range s.after {
+		if statuses[before] != JobDone {
+			return "", true
+		}
+		if i > 0 && !strings.HasSuffix(input, "\n") {
+			input = input + "\n"
+		}
+		input = input + outputs[before]
+	}
+	return input, false
+}
+
+// storeStepOutput writes the output into the bag of the caller through the bag endpoint of this node.
+func storeStepOutput(outputBag string, name string, content string) error {
+	url, err := wasm.BagUrl(outputBag)
+	if err != nil {
+		return err
+	}
+	reply, err := mesh.OpenPeerRequest(url+"&name="+name, "PUT", strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	return reply.Close()
+}
+
+func setStepStatus(burst string, pipeline string, name string, status string) {
+	setSessionLine(burst, englang.Printf("Pipeline %s step %s ", pipeline, name), englang.Printf("Pipeline %s step %s is %s.", pipeline, name, status))
+}
@@ -0,0 +1,99 @@
+package burst
+
+import (
+	"errors"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/englang"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Burst results are an Englang line followed by the standard error and the standard output.
+// Boxes send them with a PUT to /idle, and failed bursts return them with a status of 500, or 504, if they timed out.
+// curl -X PUT -d 'Run the following shell code.ls /missing' 'https://example.com/run?apikey=<burst>'
+// Burst exited with code 2 after 12 milliseconds using 3 cpu milliseconds. It wrote 54 bytes of standard error and 0 bytes of standard output.
+// ls: cannot access '/missing': No such file or directory
+// Successful bursts return the standard output only, and the line is in the Burst-Result header.
+// Bursts stopped by the sandbox or the box have the code -1, and the reason is at the end of the standard error.
+
+const resultPattern = "Burst %s with code %s after %s milliseconds using %s cpu milliseconds. It wrote %s bytes of standard error and %s bytes of standard output."
+
+// streamedPattern is appended, if the burst streamed bags.
+const streamedPattern = " It streamed %s bytes from bags and %s bytes to bags."
+
+const resultHeader = "Burst-Result"
+
+func resultLine(result sandbox.Result) string {
+	ended := "exited"
+	if result.TimedOut {
+		ended = "timed out"
+	}
+	line := englang.Printf(resultPattern, ended, englang.DecimalString(int64(result.ExitCode)),
+		englang.DecimalString(result.Duration.Milliseconds()), englang.DecimalString(result.Usage.Cpu.Milliseconds()),
+		englang.DecimalString(int64(len(result.Stderr))), englang.DecimalString(int64(len(result.Stdout))))
+	if result.Usage.StreamedIn != 0 || result.Usage.StreamedOut != 0 {
+		line = line + englang.Printf(streamedPattern, englang.DecimalString(result.Usage.StreamedIn), englang.DecimalString(result.Usage.StreamedOut))
+	}
+	return line
+}
+
+func formatResult(result sandbox.Result) string {
+	return resultLine(result) + "\n" + string(result.Stderr) + string(result.Stdout)
+}
+
+// parseResult reads the result sent by a box.
+func parseResult(reply string) sandbox.Result {
+	var ended, code, duration, cpu, stderr, stdout string
+	streamedIn, streamedOut := "0", "0"
+	line, rest, _ := strings.Cut(reply, "\n")
+	if nil != englang.Scanf1(line, resultPattern+streamedPattern, &ended, &code, &duration, &cpu, &stderr, &stdout, &streamedIn, &streamedOut) &&
+		nil != englang.Scanf1(line, resultPattern, &ended, &code, &duration, &cpu, &stderr, &stdout) ||
+		englang.Decimal(stderr) < 0 || englang.Decimal(stdout) < 0 ||
+		englang.Decimal(stderr)+englang.Decimal(stdout) != int64(len(rest)) {
+		return sandbox.Failure(errors.New("burst box returned an invalid result"))
+	}
+	split := englang.Decimal(stderr)
+	return sandbox.Result{
+		Stderr:   []byte(rest[:split]),
+		Stdout:   []byte(rest[split:]),
+		ExitCode: int(englang.Decimal(code)),
+		Duration: time.Duration(englang.Decimal(duration)) * time.Millisecond,
+		TimedOut: ended == "timed out",
+		Usage: sandbox.Usage{Cpu: time.Duration(englang.Decimal(cpu)) * time.Millisecond,
+			StreamedIn: englang.Decimal(streamedIn), StreamedOut: englang.Decimal(streamedOut)},
+	}
+}
+
+// resultStatus is the final status of a job or a pipeline step with the result.
+func resultStatus(result sandbox.Result) string {
+	switch {
+	case result.TimedOut:
+		return JobTimedOut
+	case result.Failed():
+		return JobFailed
+	}
+	return JobDone
+}
+
+// writeResult returns the standard output of a successful burst, and the whole result with an error status otherwise.
+func writeResult(w http.ResponseWriter, result sandbox.Result) {
+	w.Header().Set(resultHeader, resultLine(result))
+	switch resultStatus(result) {
+	case JobDone:
+		_, _ = w.Write(result.Stdout)
+		return
+	case JobTimedOut:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, _ = w.Write([]byte(formatResult(result)))
+}
@@ -30,8 +30,8 @@ func BoxCore() {
 			//	os.Exit(0)
 			//}()
 			result := RunExternalShell(command)
-			fmt.Println(command, result)
-			Curl(englang.Printf("curl -X PUT http://127.0.0.1%s/idle?apikey=%s", metadata.Http11Port, participationKey), result)
+			fmt.Println(command, string(result.Stdout))
+			Curl(englang.Printf("curl -X PUT http://127.0.0.1%s/idle?apikey=%s", metadata.Http11Port, participationKey), formatResult(result))
 			break
 		}
 		time.Sleep(10 * time.Millisecond)
@@ -0,0 +1,34 @@
+package runtimes
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// The interpreter paths match the usual images of the cloud farm. Change them with Get, if your image differs.
+
+func init() {
+	Register("python", &Runtime{
+		Prefix:      "Run the following python code.",
+		Interpreter: "/usr/bin/python3",
+		Extension:   ".py",
+		Mock:        "print(\"Hello World!\")",
+		MockResult:  "Hello World!\n",
+	})
+	Register("node", &Runtime{
+		Prefix:      "Run the following node code.",
+		Interpreter: "/usr/bin/node",
+		Extension:   ".js",
+		Mock:        "console.log(\"Hello World!\")",
+		MockResult:  "Hello World!\n",
+	})
+	Register("shell", &Runtime{
+		Prefix:      "Run the following shell code.",
+		Interpreter: "/bin/sh",
+		Extension:   ".sh",
+		Mock:        "echo Hello World!",
+		MockResult:  "Hello World!\n",
+	})
+}
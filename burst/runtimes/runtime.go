@@ -0,0 +1,136 @@
+package runtimes
+
+import (
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Runtimes are the languages bursts can run. Each one is selected by an Englang prefix of the task.
+// Run the following python code.print("Hello World!")
+// The code is written into the work directory, and the interpreter runs it in the sandbox.
+// Python, Node and shell are registered here, php registers itself in burst/php, and WASM in burst/wasm.
+// Native runtimes like WASM run the code in the box process without the sandbox, if they isolate it themselves.
+// Other languages can be plugged in with Register.
+// Each runtime has a mock code returning a fixed result without running the interpreter for tests.
+
+type Runtime struct {
+	Prefix      string
+	Interpreter string
+	Arguments   []string
+	Extension   string
+	Timeout     time.Duration
+	Mock        string
+	MockResult  string
+	Native      func(code string, streams sandbox.Streams, limits sandbox.Limits) sandbox.Result
+}
+
+var runtimes = map[string]*Runtime{}
+
+// Register adds or replaces a runtime. A nil runtime removes it.
+func Register(name string, runtime *Runtime) {
+	if runtime == nil {
+		delete(runtimes, name)
+		return
+	}
+	runtimes[name] = runtime
+}
+
+// Get returns a registered runtime, so that its interpreter, timeout or mock can be changed.
+func Get(name string) *Runtime {
+	return runtimes[name]
+}
+
+func Names() []string {
+	ret := make([]string, 0)
+	for name := range runtimes {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Find returns the runtime of a task and the code to run.
+func Find(task string) (string, *Runtime, string) {
+	for name, runtime := range runtimes {
+		if runtime.Prefix != "" && strings.HasPrefix(task, runtime.Prefix) {
+			return name, runtime, task[len(runtime.Prefix):]
+		}
+	}
+	return "", nil, ""
+}
+
+func (r *Runtime) IsAvailable() bool {
+	if r.Native != nil {
+		return true
+	}
+	_, err := os.Stat(r.Interpreter)
+	return err == nil
+}
+
+// RunTask runs a task with its runtime. It returns false, if the task does not start with the prefix of a runtime.
+// The runtime timeout is used, if it is set.
+func RunTask(key string, task string, timeout time.Duration) (sandbox.Result, bool) {
+	return RunTaskStreams(key, task, timeout, sandbox.Streams{})
+}
+
+// RunTaskStreams runs a task like RunTask with its standard input and output connected to the streams.
+func RunTaskStreams(key string, task string, timeout time.Duration, streams sandbox.Streams) (sandbox.Result, bool) {
+	_, runtime, code := Find(task)
+	if runtime == nil {
+		return sandbox.Result{}, false
+	}
+	if runtime.Timeout > 0 {
+		timeout = runtime.Timeout
+	}
+	return runtime.RunStreams(key, code, timeout, streams), true
+}
+
+// Run runs the code in the sandbox or natively. The code is the only file in the work directory.
+func (r *Runtime) Run(key string, code string, timeout time.Duration) sandbox.Result {
+	return r.RunStreams(key, code, timeout, sandbox.Streams{})
+}
+
+// RunStreams runs the code like Run with its standard input and output connected to the streams.
+// Streamed output is limited by the bag quota instead of the burst output limit.
+func (r *Runtime) RunStreams(key string, code string, timeout time.Duration, streams sandbox.Streams) sandbox.Result {
+	if r.Mock != "" && code == r.Mock {
+		if streams.Stdout != nil {
+			_, err := io.WriteString(streams.Stdout, r.MockResult)
+			if err != nil {
+				return sandbox.Failure(err)
+			}
+			return sandbox.Result{}
+		}
+		return sandbox.Result{Stdout: []byte(r.MockResult)}
+	}
+	limits := sandbox.DefaultLimits(timeout)
+	if streams.Stdout != nil {
+		limits.Output = metadata.BagQuota
+	}
+	if r.Native != nil {
+		return r.Native(code, streams, limits)
+	}
+	work, err := sandbox.NewWork(key)
+	if err != nil {
+		return sandbox.Failure(err)
+	}
+	defer func() { _ = os.RemoveAll(work) }()
+	_ = os.WriteFile(path.Join(work, key+r.Extension), []byte(code), 0700)
+
+	command := append([]string{r.Interpreter}, r.Arguments...)
+	command = append(command, path.Join(sandbox.WorkDir, key+r.Extension))
+	return sandbox.ExecuteStreams(limits, work, streams, command...)
+}
@@ -0,0 +1,354 @@
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bursts without a container engine run in new user, mount, pid, ipc, uts and network namespaces.
+// The server starts itself again in the namespaces, and the copy builds the root filesystem before it runs the burst.
+// The root is an empty tmpfs with read-only binds of the system directories, the work directory, /tmp and /dev.
+// The host root is detached, so that the server data, bags and other bursts are not visible.
+// The burst runs as root of its user namespace mapped to metadata.BurstUser or the server user on the host.
+
+const rootVariable = "WELLWISH_SANDBOX_ROOT"
+const workVariable = "WELLWISH_SANDBOX_WORK"
+const limitsVariable = "WELLWISH_SANDBOX_LIMITS"
+
+// rlimitNproc and prSetNoNewPrivs are missing from syscall. The number of RLIMIT_NPROC is 6 on most architectures.
+const rlimitNproc = 6
+const prSetNoNewPrivs = 38
+
+var systemDirectories = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc"}
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+const burstPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+func init() {
+	if os.Getenv(rootVariable) == "" {
+		return
+	}
+	err := startBurst()
+	_, _ = fmt.Fprintln(os.Stderr, "sandbox:", err)
+	os.Exit(126)
+}
+
+// runInNamespaces runs a burst in new namespaces. The cpu time used is read from its cgroup, or it is the cpu time of the burst process and its children.
+func runInNamespaces(limits Limits, work string, streams Streams, command []string) Result {
+	// The burst user may not be able to reach the server binary, so it is passed as an open file.
+	self, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return Failure(ErrNoSandbox)
+	}
+	defer func() { _ = self.Close() }()
+	root, err := os.MkdirTemp(metadata.StorageRoot, "rootfs")
+	if err != nil {
+		return Failure(err)
+	}
+	defer func() { _ = os.Remove(root) }()
+	start, started, err := os.Pipe()
+	if err != nil {
+		return Failure(err)
+	}
+	defer func() { _ = start.Close() }()
+	defer func() { _ = started.Close() }()
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = metadata.BurstUser, metadata.BurstUser
+		_ = os.Chown(root, uid, gid)
+	}
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !limits.Network {
+		flags = flags | syscall.CLONE_NEWNET
+	}
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/fd/4",
+		Args:       append([]string{"burst"}, command...),
+		Env:        []string{rootVariable + "=" + root, workVariable + "=" + work, limitsVariable + "=" + formatLimits(limits)},
+		ExtraFiles: []*os.File{start, self},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:                 uintptr(flags),
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+			GidMappingsEnableSetgroups: false,
+			// The credential makes the burst the mapped root of its namespace, so that it keeps the capabilities to build its root.
+			Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+	// Killing the first process of the pid namespace kills all the processes of the burst.
+	stop := func() { _ = cmd.Process.Kill() }
+	stdout, stderr := newOutputWriter(limits.Output, streams.Stdout, stop), bytes.Buffer{}
+	cmd.Stdin = streams.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	began := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		return Failure(fmt.Errorf("%w: %v", ErrNoSandbox, err))
+	}
+	cgroup := joinCgroup(cmd.Process.Pid, limits)
+	defer leaveCgroup(cgroup)
+	// The burst waits until it is in its cgroup.
+	_, _ = started.Write([]byte{1})
+	_ = started.Close()
+
+	timer := time.AfterFunc(limits.Timeout, stdout.timeout)
+	err = cmd.Wait()
+	timer.Stop()
+	usage := Usage{Cpu: cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()}
+	used, ok := cgroupCpuTime(cgroup)
+	if ok {
+		usage.Cpu = used
+	}
+	return stdout.result(&stderr, err, usage, began)
+}
+
+func formatLimits(limits Limits) string {
+	return englang.Printf("Limit memory to %s bytes, cpu to %s seconds and processes to %s.",
+		englang.DecimalString(limits.Memory), englang.DecimalString(int64(cpuSeconds(limits))), englang.DecimalString(limits.Pids))
+}
+
+func parseLimits(limits string) (int64, int64, int64) {
+	var memory, cpu, pids string
+	if nil != englang.Scanf1(limits, "Limit memory to %s bytes, cpu to %s seconds and processes to %s.", &memory, &cpu, &pids) {
+		return 0, 0, 0
+	}
+	return englang.Decimal(memory), englang.Decimal(cpu), englang.Decimal(pids)
+}
+
+// joinCgroup puts the burst into a new cgroup with its limits. It returns an empty string, if cgroups are not usable.
+func joinCgroup(pid int, limits Limits) string {
+	_, err := os.Stat(path.Join(metadata.BurstCgroup, "cgroup.controllers"))
+	if err != nil {
+		if os.Mkdir(metadata.BurstCgroup, 0755) != nil {
+			return ""
+		}
+		_ = os.WriteFile(path.Join(path.Dir(metadata.BurstCgroup), "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+	}
+	_ = os.WriteFile(path.Join(metadata.BurstCgroup, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+	cgroup := path.Join(metadata.BurstCgroup, drawing.GenerateUniqueKey()[:16])
+	if os.Mkdir(cgroup, 0755) != nil {
+		return ""
+	}
+	settings := map[string]string{
+		"cpu.max":         fmt.Sprintf("%d 100000", int64(limits.Cpu*100000)),
+		"memory.max":      fmt.Sprintf("%d", limits.Memory),
+		"memory.swap.max": "0",
+		"pids.max":        fmt.Sprintf("%d", limits.Pids),
+		"cgroup.procs":    fmt.Sprintf("%d", pid),
+	}
+	for _, setting := range []string{"cpu.max", "memory.max", "memory.swap.max", "pids.max", "cgroup.procs"} {
+		err = os.WriteFile(path.Join(cgroup, setting), []byte(settings[setting]), 0644)
+		if err != nil && setting != "memory.swap.max" {
+			_ = os.Remove(cgroup)
+			return ""
+		}
+	}
+	return cgroup
+}
+
+// cgroupCpuTime reads the cpu time used by all the processes of the cgroup.
+func cgroupCpuTime(cgroup string) (time.Duration, bool) {
+	if cgroup == "" {
+		return 0, false
+	}
+	stat, err := os.ReadFile(path.Join(cgroup, "cpu.stat"))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if strings.HasPrefix(line, "usage_usec ") {
+			return time.Duration(englang.Decimal(strings.TrimPrefix(line, "usage_usec "))) * time.Microsecond, true
+		}
+	}
+	return 0, false
+}
+
+func leaveCgroup(cgroup string) {
+	if cgroup == "" {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		if os.Remove(cgroup) == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startBurst runs in the new namespaces. It builds the root filesystem, applies the limits, and it replaces itself with the burst.
+func startBurst() error {
+	root, work := os.Getenv(rootVariable), os.Getenv(workVariable)
+	memory, cpu, pids := parseLimits(os.Getenv(limitsVariable))
+	if root == "" || work == "" || len(os.Args) < 2 {
+		return errors.New("missing burst")
+	}
+	start := os.NewFile(3, "start")
+	_, _ = io.ReadFull(start, make([]byte, 1))
+	_ = start.Close()
+	syscall.CloseOnExec(4)
+
+	err := buildRoot(root, work, memory)
+	if err != nil {
+		return err
+	}
+	_ = syscall.Sethostname([]byte("burst"))
+	for resource, limit := range map[int]int64{syscall.RLIMIT_AS: memory, syscall.RLIMIT_FSIZE: memory, syscall.RLIMIT_CPU: cpu, rlimitNproc: pids, syscall.RLIMIT_CORE: 0} {
+		if limit > 0 || resource == syscall.RLIMIT_CORE {
+			err = syscall.Setrlimit(resource, &syscall.Rlimit{Cur: uint64(limit), Max: uint64(limit)})
+			if err != nil {
+				return fmt.Errorf("rlimit %d: %w", resource, err)
+			}
+		}
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	env := []string{"PATH=" + burstPath, "HOME=" + WorkDir, "TMPDIR=/tmp", "LANG=C.UTF-8"}
+	_ = os.Setenv("PATH", burstPath)
+	program, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(program, os.Args[1:], env)
+}
+
+func buildRoot(root string, work string, memory int64) error {
+	err := mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+	err = mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID, "size=1m,mode=0755")
+	if err != nil {
+		return err
+	}
+	for _, directory := range systemDirectories {
+		err = bindSystemDirectory(directory, path.Join(root, directory))
+		if err != nil {
+			return err
+		}
+	}
+	err = bindDirectory(work, path.Join(root, WorkDir), syscall.MS_NODEV)
+	if err != nil {
+		return err
+	}
+	tmpSize := "size=" + englang.DecimalString(memory)
+	if memory <= 0 {
+		tmpSize = "size=50%"
+	}
+	err = mountDirectory("tmpfs", path.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, tmpSize+",mode=1777")
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(path.Join(root, "dev"), 0755)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		err = os.WriteFile(path.Join(root, device), []byte{}, 0666)
+		if err == nil {
+			err = mount(device, path.Join(root, device), "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Some hosts do not allow a new /proc. Bursts run without it then.
+	_ = mountDirectory("proc", path.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	oldRoot := path.Join(root, ".host")
+	err = os.Mkdir(oldRoot, 0700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(root, oldRoot)
+	if err != nil {
+		return fmt.Errorf("pivot root: %w", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount("/.host", syscall.MNT_DETACH)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove("/.host")
+	err = mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID, "")
+	if err != nil {
+		return err
+	}
+	return syscall.Chdir(WorkDir)
+}
+
+func mountDirectory(source string, target string, fstype string, flags uintptr, data string) error {
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return err
+	}
+	return mount(source, target, fstype, flags, data)
+}
+
+// bindSystemDirectory binds a system directory read-only. Symbolic links like /bin -> usr/bin are copied.
+func bindSystemDirectory(source string, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if !info.IsDir() || strings.Contains(source, "..") {
+		return nil
+	}
+	return bindDirectory(source, target, syscall.MS_RDONLY)
+}
+
+// bindDirectory binds a directory without setuid programs keeping the flags of the host mount.
+func bindDirectory(source string, target string, flags uintptr) error {
+	err := mountDirectory(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+	stat := syscall.Statfs_t{}
+	err = syscall.Statfs(target, &stat)
+	if err != nil {
+		return err
+	}
+	// The statfs flags of nosuid, nodev, noexec and the atime options match the mount flags.
+	kept := uintptr(stat.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	return mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_NOSUID|flags|kept, "")
+}
+
+func mount(source string, target string, fstype string, flags uintptr, data string) error {
+	err := syscall.Mount(source, target, fstype, flags, data)
+	if err != nil {
+		return fmt.Errorf("mount %s: %w", target, err)
+	}
+	return nil
+}
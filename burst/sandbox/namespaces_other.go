@@ -0,0 +1,16 @@
+//go:build !linux
+
+package sandbox
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Namespaces are only available on Linux. Install docker or podman to run bursts elsewhere.
+
+func runInNamespaces(limits Limits, work string, streams Streams, command []string) Result {
+	return Failure(ErrNoSandbox)
+}
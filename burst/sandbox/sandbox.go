@@ -0,0 +1,291 @@
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Sandbox runs burst code isolated from the server.
+// Bursts run with docker or podman, if one is present, or in Linux namespaces otherwise.
+// Each burst gets a read-only root filesystem, an empty /tmp, and its own work directory mounted as /work.
+// Bursts have no network, unless metadata.BurstNetwork is set.
+// CPU, memory and processes are limited by a cgroup, if metadata.BurstCgroup is writable, and by rlimits.
+// Burst code never runs in the host process space. Run returns an error, if there is no way to isolate it.
+// Each run is capped by its memory, cpu time and output size, and Run returns the cpu time used for accounting.
+// Execute returns the exit code, standard error, duration and timeout of the run as well.
+// ExecuteStreams reads the standard input and writes the standard output of the run to streams, like files of large payloads.
+// docker run --rm --network none --read-only --tmpfs /tmp --cpus 1 --memory 1g --pids-limit 64 -v <work>:/work php:8-cli php /work/<key>
+
+const WorkDir = "/work"
+
+var ErrNoSandbox = errors.New("no sandbox is available to run bursts")
+var ErrOutputLimit = errors.New("burst output limit exceeded")
+var ErrTimeout = errors.New("burst timed out")
+
+type Limits struct {
+	Cpu     float64
+	CpuTime time.Duration
+	Memory  int64
+	Output  int64
+	Pids    int64
+	Network bool
+	Timeout time.Duration
+}
+
+// Usage is the accounting of a single run. Streamed bytes are read from and written to bags by the box.
+type Usage struct {
+	Cpu         time.Duration
+	StreamedIn  int64
+	StreamedOut int64
+}
+
+// Result is the outcome of a single run. Err is set, if the run did not exit with zero.
+// Runs stopped by the sandbox have the exit code -1, and the reason is appended to the standard error.
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Duration time.Duration
+	TimedOut bool
+	Usage    Usage
+	Err      error
+}
+
+func (r Result) Failed() bool {
+	return r.Err != nil || r.ExitCode != 0 || r.TimedOut
+}
+
+// Failure returns the result of a run stopped by an error.
+func Failure(err error) Result {
+	result := Result{}
+	result.Stop(err)
+	return result
+}
+
+// Stop records the error that stopped the run.
+func (r *Result) Stop(err error) {
+	r.Err = err
+	r.ExitCode = -1
+	r.TimedOut = r.TimedOut || errors.Is(err, ErrTimeout)
+	r.Stderr = append(r.Stderr, []byte(err.Error()+"\n")...)
+}
+
+// Streams are the standard input and output of a run. Runs read an empty input, and their output is in the result, if they are nil.
+// The output limit applies to the output written to the stream as well.
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+}
+
+func DefaultLimits(timeout time.Duration) Limits {
+	return Limits{
+		Cpu:     metadata.BurstCpu,
+		CpuTime: metadata.BurstCpuTime,
+		Memory:  metadata.BurstMemory,
+		Output:  metadata.BurstOutput,
+		Pids:    metadata.BurstPids,
+		Network: metadata.BurstNetwork,
+		Timeout: timeout,
+	}
+}
+
+// NewWork creates an empty work directory for a single burst. Remove it with os.RemoveAll, when the burst is done.
+func NewWork(key string) (string, error) {
+	work := path.Join(metadata.StorageRoot, key+".burst")
+	err := os.MkdirAll(work, 0700)
+	if err != nil {
+		return "", err
+	}
+	return work, nil
+}
+
+// Run runs a command line in the sandbox with work mounted as /work, and it returns the standard output.
+// The command is killed, when it runs longer than the timeout, or it writes more than the output limit.
+func Run(limits Limits, work string, command ...string) ([]byte, Usage, error) {
+	result := Execute(limits, work, command...)
+	return result.Stdout, result.Usage, result.Err
+}
+
+// Execute runs a command line like Run, and it returns the structured result.
+func Execute(limits Limits, work string, command ...string) Result {
+	return ExecuteStreams(limits, work, Streams{}, command...)
+}
+
+// ExecuteStreams runs a command line like Execute with its standard input and output connected to the streams.
+func ExecuteStreams(limits Limits, work string, streams Streams, command ...string) Result {
+	if streams.Stdin == nil {
+		streams.Stdin = bytes.NewBuffer([]byte{})
+	}
+	if len(command) == 0 || command[0] == "" {
+		return Failure(errors.New("no command to run"))
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = time.Minute
+	}
+	err := shareWork(work)
+	if err != nil {
+		return Failure(err)
+	}
+	engine := findEngine()
+	if engine != "" {
+		return runInContainer(engine, limits, work, streams, command)
+	}
+	return runInNamespaces(limits, work, streams, command)
+}
+
+func findEngine() string {
+	if metadata.BurstSandbox != "" {
+		engine, err := exec.LookPath(metadata.BurstSandbox)
+		if err != nil {
+			return ""
+		}
+		return engine
+	}
+	for _, engine := range []string{"podman", "docker"} {
+		found, err := exec.LookPath(engine)
+		if err == nil {
+			return found
+		}
+	}
+	return ""
+}
+
+// shareWork hands the work directory over to the burst user, if the server runs as root.
+func shareWork(work string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	return filepath.Walk(work, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, metadata.BurstUser, metadata.BurstUser)
+	})
+}
+
+// runInContainer runs a burst with docker or podman.
+// Engines do not report the cpu time of removed containers, so the runtime on all the cores allowed is accounted.
+func runInContainer(engine string, limits Limits, work string, streams Streams, command []string) Result {
+	name := "burst-" + drawing.GenerateUniqueKey()[:16]
+	args := []string{"run", "--rm", "-i", "--name", name,
+		"--read-only", "--tmpfs", "/tmp",
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--cpus", fmt.Sprintf("%g", limits.Cpu),
+		"--memory", fmt.Sprintf("%d", limits.Memory),
+		"--pids-limit", fmt.Sprintf("%d", limits.Pids),
+		"-v", work + ":" + WorkDir, "-w", WorkDir}
+	if !limits.Network {
+		args = append(args, "--network", "none")
+	}
+	if os.Getuid() == 0 {
+		args = append(args, "--user", fmt.Sprintf("%d:%d", metadata.BurstUser, metadata.BurstUser))
+	}
+	args = append(args, metadata.BurstImage)
+	args = append(args, command...)
+	cmd := exec.Command(engine, args...)
+	stop := func() {
+		// The client of the engine may exit without stopping the container.
+		_ = exec.Command(engine, "kill", name).Run()
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+		}
+	}
+	stdout, stderr := newOutputWriter(limits.Output, streams.Stdout, stop), bytes.Buffer{}
+	cmd.Stdin = streams.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	started := time.Now()
+	timer := time.AfterFunc(limits.Timeout, stdout.timeout)
+	err := cmd.Run()
+	timer.Stop()
+	used := time.Duration(float64(time.Now().Sub(started)) * limits.Cpu)
+	return stdout.result(&stderr, err, Usage{Cpu: used}, started)
+}
+
+// cpuSeconds is the cpu time allowed for a burst. It is the cpu time limit, or the runtime on all the cores allowed, if it is less.
+func cpuSeconds(limits Limits) uint64 {
+	seconds := limits.Timeout.Seconds() * math.Max(limits.Cpu, 0.01)
+	if limits.CpuTime > 0 {
+		seconds = math.Min(seconds, limits.CpuTime.Seconds())
+	}
+	return uint64(math.Max(1, math.Ceil(seconds)))
+}
+
+// outputWriter collects the standard output of a burst, and it stops the burst, when it writes more than the limit.
+// It also stops the burst at its timeout. The output is written to the target instead of the buffer, if it is set.
+type outputWriter struct {
+	buffer   bytes.Buffer
+	target   io.Writer
+	left     int64
+	exceeded bool
+	timedOut atomic.Bool
+	stop     func()
+}
+
+func newOutputWriter(limit int64, target io.Writer, stop func()) *outputWriter {
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	o := &outputWriter{left: limit, target: target, stop: stop}
+	if o.target == nil {
+		o.target = &o.buffer
+	}
+	return o
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	if o.exceeded {
+		return 0, ErrOutputLimit
+	}
+	if int64(len(p)) > o.left {
+		_, _ = o.target.Write(p[:o.left])
+		o.left = 0
+		o.exceeded = true
+		o.stop()
+		return 0, ErrOutputLimit
+	}
+	o.left = o.left - int64(len(p))
+	return o.target.Write(p)
+}
+
+func (o *outputWriter) timeout() {
+	o.timedOut.Store(true)
+	o.stop()
+}
+
+// result returns the output collected. The output limit and the timeout are reported instead of the exit status of the stopped burst.
+func (o *outputWriter) result(stderr *bytes.Buffer, err error, usage Usage, started time.Time) Result {
+	result := Result{Stdout: o.buffer.Bytes(), Stderr: stderr.Bytes(), Duration: time.Now().Sub(started), Usage: usage, Err: err}
+	exitError, ok := err.(*exec.ExitError)
+	if ok {
+		exitError.Stderr = stderr.Bytes()
+		result.ExitCode = exitError.ExitCode()
+	}
+	switch {
+	case o.exceeded:
+		result.Stop(ErrOutputLimit)
+	case o.timedOut.Load():
+		result.Stop(ErrTimeout)
+	case err != nil && !ok:
+		result.Stop(err)
+	}
+	return result
+}
@@ -0,0 +1,284 @@
+package burst
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/mesh"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Bursts can run on a schedule of the burst session. The first line is the schedule, and the rest is the task.
+// curl -X PUT -d $'Run this every day at 02:00 UTC.\nRun the following shell code.echo refresh' 'https://example.com/run.schedule?apikey=<burst>' returns a schedule id.
+// curl -X DELETE 'https://example.com/run.schedule?apikey=<burst>&schedule=<id>'
+// Schedules are written as one of these.
+// Run this every day at 02:00 UTC.
+// Run this every monday at 02:00 UTC.
+// Run this every hour at 15 minutes.
+// Run this every 10 minutes.
+// Minutes divide an hour like 1, 2, 3, 4, 5, 6, 10, 12, 15, 20 or 30.
+// Run this at cron 0 2 * * 1-5.
+// Cron expressions have minute, hour, day of month, month and day of week fields in UTC.
+// The node owning the index of the burst session runs the schedule. Sessions restored from a backup are indexed on the restoring node.
+// The task has up to 1 MiB like jobs.
+// The schedule and its recent runs are lines of the burst session.
+// Schedule <id> runs at 0 2 * * * UTC.
+// Schedule <id> ran at 2023-06-01 02:00:00 and it was done with 4096 bytes out.
+
+const schedulePattern = "Schedule of burst %s runs at %s UTC."
+const maxScheduleHistory = 10
+
+var BurstSchedules = map[string]string{}
+
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+func setupSchedules() {
+	http.HandleFunc("/run.schedule", func(w http.ResponseWriter, r *http.Request) {
+		if nil == mesh.RedirectToPeerServer(w, r) {
+			return
+		}
+		apiKey := r.URL.Query().Get("apikey")
+		lock.Lock()
+		_, call := BurstSession[apiKey]
+		lock.Unlock()
+		if !call {
+			management.QuantumGradeAuthorization()
+			w.WriteHeader(http.StatusPaymentRequired)
+			drawing.NoErrorWrite(w.Write([]byte("Payment required with a PUT to /run.coin")))
+			return
+		}
+		if r.Method == "PUT" {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJobSize))
+			if err != nil {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			schedule, task, _ := strings.Cut(string(body), "\n")
+			cron, err := parseSchedule(strings.TrimSpace(schedule))
+			if err != nil || task == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(addSchedule(apiKey, cron, task)))
+			return
+		}
+		if r.Method == "DELETE" {
+			id := r.URL.Query().Get("schedule")
+			burst, _, _ := getSchedule(id)
+			if burst != apiKey {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			deleteSchedule(id)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+
+	go func() {
+		for {
+			next := time.Now().Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(next.Sub(time.Now()))
+			runSchedules(next)
+		}
+	}()
+}
+
+func addSchedule(burst string, cron string, task string) string {
+	id := drawing.GenerateUniqueKey()
+	lock.Lock()
+	BurstSchedules[id] = englang.Printf(schedulePattern, burst, cron) + "\n" + task
+	lock.Unlock()
+	setSessionLine(burst, englang.Printf("Schedule %s ", id), englang.Printf("Schedule %s runs at %s UTC.", id, cron))
+	return id
+}
+
+func getSchedule(id string) (string, string, string) {
+	lock.Lock()
+	defer lock.Unlock()
+	var burst, cron string
+	record, task, _ := strings.Cut(BurstSchedules[id], "\n")
+	if nil != englang.Scanf1(record, schedulePattern, &burst, &cron) {
+		return "", "", ""
+	}
+	return burst, cron, task
+}
+
+func deleteSchedule(id string) {
+	burst, _, _ := getSchedule(id)
+	lock.Lock()
+	delete(BurstSchedules, id)
+	lock.Unlock()
+	setSessionLine(burst, englang.Printf("Schedule %s ", id), "")
+}
+
+// runSchedules starts the schedules due at the minute, if this node owns the index of their session.
+// Schedules of deleted sessions are removed.
+func runSchedules(minute time.Time) {
+	lock.Lock()
+	ids := make([]string, 0)
+	for id := range BurstSchedules {
+		ids = append(ids, id)
+	}
+	lock.Unlock()
+	for _, id := range ids {
+		burst, cron, task := getSchedule(id)
+		lock.Lock()
+		_, valid := BurstSession[burst]
+		lock.Unlock()
+		if !valid {
+			deleteSchedule(id)
+			continue
+		}
+		if mesh.GetIndex(burst) != mesh.WhoAmI || !cronMatches(cron, minute.UTC()) {
+			continue
+		}
+		go func(id string, burst string, task string) {
+			result, status := runBurst(burst, task, JobQueueTime, nil)
+			recordScheduledRun(burst, id, minute, status, len(result.Stdout))
+		}(id, burst, task)
+	}
+}
+
+// recordScheduledRun appends the run to the session, and it keeps the recent runs only.
+func recordScheduledRun(burst string, id string, started time.Time, status string, out int) {
+	line := englang.Printf("Schedule %s ran at %s and it was %s with %s bytes out.", id,
+		started.UTC().Format("2006-01-02 15:04:05"), status, englang.DecimalString(int64(out)))
+	prefix := englang.Printf("Schedule %s ran at ", id)
+	lock.Lock()
+	defer lock.Unlock()
+	record, ok := BurstSession[burst]
+	if !ok {
+		return
+	}
+	lines := strings.Split(record, "\n")
+	history := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], prefix) {
+			history++
+			if history >= maxScheduleHistory {
+				lines = append(lines[:i], lines[i+1:]...)
+			}
+		}
+	}
+	BurstSession[burst] = strings.Join(append(lines, line), "\n")
+}
+
+// parseSchedule returns the cron expression of an Englang schedule.
+func parseSchedule(schedule string) (string, error) {
+	var cron, day, at, minutes string
+	switch {
+	case nil == englang.Scanf1(schedule, "Run this at cron %s.", &cron):
+	case nil == englang.Scanf1(schedule, "Run this every hour at %s minutes.", &minutes):
+		cron = minutes + " * * * *"
+	case nil == englang.Scanf1(schedule, "Run this every %s minutes.", &minutes):
+		// Steps restart every hour, so only divisors of 60 run evenly.
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 || n >= 60 || 60%n != 0 {
+			return "", fmt.Errorf("every %s minutes is not a divisor of an hour", minutes)
+		}
+		cron = "*/" + minutes + " * * * *"
+	case nil == englang.Scanf1(schedule, "Run this every %s at %s UTC.", &day, &at):
+		hour, minute, _ := strings.Cut(at, ":")
+		h, err1 := strconv.Atoi(hour)
+		m, err2 := strconv.Atoi(minute)
+		if err1 != nil || err2 != nil {
+			return "", fmt.Errorf("time %s is not valid", at)
+		}
+		weekday := "*"
+		for i, name := range weekdays {
+			if strings.ToLower(day) == name {
+				weekday = strconv.Itoa(i)
+			}
+		}
+		if weekday == "*" && day != "day" {
+			return "", fmt.Errorf("day %s is not valid", day)
+		}
+		cron = fmt.Sprintf("%d %d * * %s", m, h, weekday)
+	default:
+		return "", errors.New("schedule is not valid")
+	}
+	_, err := parseCron(cron)
+	if err != nil {
+		return "", err
+	}
+	return cron, nil
+}
+
+// parseCron returns the allowed values of the cron fields as bit masks.
+func parseCron(cron string) ([5]uint64, error) {
+	ranges := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	masks := [5]uint64{}
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		return masks, fmt.Errorf("cron %s does not have five fields", cron)
+	}
+	for i, field := range fields {
+		for _, item := range strings.Split(field, ",") {
+			span, step, stepped := strings.Cut(item, "/")
+			every := 1
+			if stepped {
+				n, err := strconv.Atoi(step)
+				if err != nil || n <= 0 {
+					return masks, fmt.Errorf("cron field %s is not valid", field)
+				}
+				every = n
+			}
+			low, high := ranges[i][0], ranges[i][1]
+			if span != "*" {
+				from, to, isRange := strings.Cut(span, "-")
+				var err1, err2 error
+				low, err1 = strconv.Atoi(from)
+				high, err2 = low, nil
+				if isRange {
+					high, err2 = strconv.Atoi(to)
+				} else if stepped {
+					high = ranges[i][1]
+				}
+				if err1 != nil || err2 != nil || low < ranges[i][0] || high > ranges[i][1] || low > high {
+					return masks, fmt.Errorf("cron field %s is not valid", field)
+				}
+			}
+			for v := low; v <= high; v += every {
+				masks[i] |= 1 << uint(v)
+			}
+		}
+	}
+	// Sunday is 0 or 7.
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return masks, nil
+}
+
+func cronMatches(cron string, t time.Time) bool {
+	masks, err := parseCron(cron)
+	if err != nil {
+		return false
+	}
+	matches := func(i int, v int) bool { return masks[i]&(1<<uint(v)) != 0 }
+	if !matches(0, t.Minute()) || !matches(1, t.Hour()) || !matches(3, int(t.Month())) {
+		return false
+	}
+	fields := strings.Fields(cron)
+	day, weekday := matches(2, t.Day()), matches(4, int(t.Weekday()))
+	// Cron runs on either day, if both the day of month and the day of week are restricted.
+	if fields[2] != "*" && fields[4] != "*" {
+		return day || weekday
+	}
+	return day && weekday
+}
@@ -0,0 +1,141 @@
+package burst
+
+import (
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/burst/wasm"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"os"
+	"strings"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Large inputs and outputs are streamed by the box from and to bags, so that they do not pass through the server.
+// The first line of the burst refers to the bags by their api key, and the rest is the task.
+// curl -X PUT http://127.0.0.1:7777/tmp?apikey=DEF --data-binary @input.csv
+// curl -X PUT http://127.0.0.1:7777/run?apikey=ABC -d 'Run with input bag DEF and write output to bag GHI.
+// Run the following python code.import sys; print(len(sys.stdin.read()))'
+// curl -X GET http://127.0.0.1:7777/tmp?apikey=GHI
+// Either bag can be left out.
+// Run with input bag DEF.
+// Run and write output to bag GHI.
+// The input bag is the standard input of the burst. The output bag is replaced with the standard output, if the burst succeeded.
+// The result has the standard error only, when the output is written to a bag. Streamed output is limited by metadata.BagQuota.
+// Bags are reached through the bag endpoint of this node even without metadata.BurstNetwork, so urls are refused.
+// Streamed bytes are metered with the input and the output of the run.
+
+// parseStreams returns the input bag, the output bag and the task of a burst referring to bags.
+func parseStreams(task string) (string, string, string, bool) {
+	var input, output string
+	line, rest, _ := strings.Cut(task, "\n")
+	// The sentence is matched up to its period at the end.
+	line = strings.TrimSpace(line)
+	if !strings.HasSuffix(line, ".") {
+		return "", "", "", false
+	}
+	line = strings.TrimSuffix(line, ".") + "KQHZXWVBNMAGSPLRTYFJD"
+	switch {
+	case nil == englang.Scanf1(line, "Run with input bag %s and write output to bag %s"+"KQHZXWVBNMAGSPLRTYFJD", &input, &output):
+	case nil == englang.Scanf1(line, "Run with input bag %s"+"KQHZXWVBNMAGSPLRTYFJD", &input):
+	case nil == englang.Scanf1(line, "Run and write output to bag %s"+"KQHZXWVBNMAGSPLRTYFJD", &output):
+	default:
+		return "", "", "", false
+	}
+	return strings.TrimSpace(input), strings.TrimSpace(output), rest, true
+}
+
+// runWithStreams downloads the input bag into a file, runs the task, and it uploads the output file to the output bag.
+func runWithStreams(input string, output string, task string) sandbox.Result {
+	streams := sandbox.Streams{}
+	var streamedIn int64
+	if input != "" {
+		in, err := streamTemp("input")
+		if err != nil {
+			return sandbox.Failure(err)
+		}
+		defer func() { _ = in.Close() }()
+		streamedIn, err = downloadBag(input, in)
+		if err != nil {
+			return sandbox.Failure(err)
+		}
+		streams.Stdin = in
+	}
+	var out *os.File
+	if output != "" {
+		var err error
+		out, err = streamTemp("output")
+		if err != nil {
+			return sandbox.Failure(err)
+		}
+		defer func() { _ = out.Close() }()
+		streams.Stdout = out
+	}
+	result := runTask(task, streams)
+	result.Usage.StreamedIn = streamedIn
+	if out != nil && !result.Failed() {
+		streamedOut, err := uploadBag(output, out)
+		result.Usage.StreamedOut = streamedOut
+		if err != nil {
+			result.Stop(err)
+		}
+	}
+	return result
+}
+
+// streamTemp is an unlinked temporary file.
+func streamTemp(name string) (*os.File, error) {
+	spool, err := os.CreateTemp(metadata.StorageRoot, name)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(spool.Name())
+	return spool, nil
+}
+
+// downloadBag returns the bytes read from the bag.
+func downloadBag(bag string, file *os.File) (int64, error) {
+	url, err := wasm.BagUrl(bag)
+	if err != nil {
+		return 0, err
+	}
+	reply, err := mesh.OpenPeerRequest(url, "GET", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = reply.Close() }()
+	n, err := io.Copy(file, reply)
+	if err != nil {
+		return n, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return n, err
+}
+
+// uploadBag returns the bytes written to the bag.
+func uploadBag(bag string, file *os.File) (int64, error) {
+	url, err := wasm.BagUrl(bag)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	reply, err := mesh.OpenPeerRequest(url, "PUT", file)
+	if err != nil {
+		return n, err
+	}
+	return n, reply.Close()
+}
@@ -0,0 +1,887 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// This is the interpreter of decoded modules.
+// Each instruction burns a unit of fuel. The burst traps, when it runs out of fuel, time or memory.
+// Values are kept as 64 bit words. Floats are stored as their bits, and references are function indexes plus one.
+
+const maxCallDepth = 2048
+
+type trap struct {
+	message string
+}
+
+type exit struct {
+	code uint32
+}
+
+type label struct {
+	height int
+	arity  int
+	target int
+	loop   bool
+}
+
+type machine struct {
+	module   *module
+	memory   []byte
+	maxPages uint32
+	tables   [][]uint64
+	globals  []uint64
+	dropped  map[string]bool
+	stack    []uint64
+	fuel     int64
+	deadline time.Time
+	depth    int
+	host     *host
+}
+
+func fail(format string, a ...interface{}) {
+	panic(trap{message: fmt.Sprintf(format, a...)})
+}
+
+func (m *machine) push(v uint64) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *machine) pop() uint64 {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+func (m *machine) pop32() uint32 {
+	return uint32(m.pop())
+}
+
+func (m *machine) push32(v uint32) {
+	m.stack = append(m.stack, uint64(v))
+}
+
+func (m *machine) pushBool(b bool) {
+	if b {
+		m.push(1)
+	} else {
+		m.push(0)
+	}
+}
+
+func (m *machine) popF32() float32 {
+	return math.Float32frombits(m.pop32())
+}
+
+func (m *machine) pushF32(f float32) {
+	m.push32(math.Float32bits(f))
+}
+
+func (m *machine) popF64() float64 {
+	return math.Float64frombits(m.pop())
+}
+
+func (m *machine) pushF64(f float64) {
+	m.push(math.Float64bits(f))
+}
+
+// address checks a memory access of size bytes.
+func (m *machine) address(offset uint64, size uint64) uint64 {
+	address := uint64(m.pop32()) + offset
+	if address+size > uint64(len(m.memory)) {
+		fail("out of bounds memory access")
+	}
+	return address
+}
+
+func (m *machine) checkRange(offset uint32, length uint32, size int) {
+	if uint64(offset)+uint64(length) > uint64(size) {
+		fail("out of bounds memory access")
+	}
+}
+
+func (m *machine) call(index uint32) {
+	if int(index) >= len(m.module.functions) {
+		fail("undefined function")
+	}
+	f := m.module.functions[index]
+	t := m.module.types[f.typ]
+	n := len(t.params)
+	if f.host != nil {
+		args := make([]uint64, n)
+		copy(args, m.stack[len(m.stack)-n:])
+		m.stack = m.stack[:len(m.stack)-n]
+		m.stack = append(m.stack, f.host(m, args)...)
+		return
+	}
+	m.depth++
+	if m.depth > maxCallDepth {
+		fail("call stack exhausted")
+	}
+	locals := make([]uint64, n+f.locals)
+	copy(locals, m.stack[len(m.stack)-n:])
+	m.stack = m.stack[:len(m.stack)-n]
+	m.execute(f.code, locals, len(t.results))
+	m.depth--
+}
+
+// branch moves the results of a block to its label, and it returns where to continue.
+func (m *machine) branch(labels []label, depth uint32) (int, []label) {
+	l := labels[len(labels)-1-int(depth)]
+	copy(m.stack[l.height:], m.stack[len(m.stack)-l.arity:])
+	m.stack = m.stack[:l.height+l.arity]
+	if l.loop {
+		return l.target, labels[:len(labels)-int(depth)]
+	}
+	return l.target, labels[:len(labels)-1-int(depth)]
+}
+
+func (m *machine) execute(code []instr, locals []uint64, arity int) {
+	base := len(m.stack)
+	labels := make([]label, 1, 16)
+	labels[0] = label{height: base, arity: arity, target: len(code)}
+	pc := 0
+	for pc < len(code) {
+		m.fuel--
+		if m.fuel < 0 {
+			fail("out of fuel")
+		}
+		if m.fuel&0xFFFF == 0 && time.Now().After(m.deadline) {
+			fail("out of time")
+		}
+		in := &code[pc]
+		switch in.op {
+		case 0x00:
+			fail("unreachable")
+		case 0x01:
+		case 0x02:
+			labels = append(labels, label{height: len(m.stack) - int(in.params), arity: int(in.results), target: int(in.end) + 1})
+		case 0x03:
+			labels = append(labels, label{height: len(m.stack) - int(in.params), arity: int(in.params), target: pc + 1, loop: true})
+		case 0x04:
+			condition := m.pop32()
+			if condition == 0 && in.els < 0 {
+				pc = int(in.end) + 1
+				continue
+			}
+			labels = append(labels, label{height: len(m.stack) - int(in.params), arity: int(in.results), target: int(in.end) + 1})
+			if condition == 0 {
+				pc = int(in.els) + 1
+				continue
+			}
+		case 0x05:
+			labels = labels[:len(labels)-1]
+			pc = int(in.end) + 1
+			continue
+		case 0x0B:
+			labels = labels[:len(labels)-1]
+		case 0x0C:
+			pc, labels = m.branch(labels, uint32(in.imm))
+			continue
+		case 0x0D:
+			if m.pop32() != 0 {
+				pc, labels = m.branch(labels, uint32(in.imm))
+				continue
+			}
+		case 0x0E:
+			i := m.pop32()
+			depth := in.labels[len(in.labels)-1]
+			if int(i) < len(in.labels)-1 {
+				depth = in.labels[i]
+			}
+			pc, labels = m.branch(labels, depth)
+			continue
+		case 0x0F:
+			pc = len(code)
+			continue
+		case 0x10:
+			m.call(uint32(in.imm))
+		case 0x11:
+			i := m.pop32()
+			t := m.table(in.imm2)
+			if int(i) >= len(t) {
+				fail("undefined element")
+			}
+			if t[i] == 0 {
+				fail("uninitialized element")
+			}
+			f := uint32(t[i] - 1)
+			if !m.module.types[m.module.functions[f].typ].equals(m.module.types[in.imm]) {
+				fail("indirect call type mismatch")
+			}
+			m.call(f)
+		case 0x1A:
+			m.pop()
+		case 0x1B:
+			condition := m.pop32()
+			b := m.pop()
+			a := m.pop()
+			if condition != 0 {
+				m.push(a)
+			} else {
+				m.push(b)
+			}
+		case 0x20:
+			m.push(locals[in.imm])
+		case 0x21:
+			locals[in.imm] = m.pop()
+		case 0x22:
+			locals[in.imm] = m.stack[len(m.stack)-1]
+		case 0x23:
+			m.push(m.globals[in.imm])
+		case 0x24:
+			m.globals[in.imm] = m.pop()
+		case 0x25:
+			t := m.table(uint32(in.imm))
+			i := m.pop32()
+			if int(i) >= len(t) {
+				fail("out of bounds table access")
+			}
+			m.push(t[i])
+		case 0x26:
+			t := m.table(uint32(in.imm))
+			v := m.pop()
+			i := m.pop32()
+			if int(i) >= len(t) {
+				fail("out of bounds table access")
+			}
+			t[i] = v
+		case 0x28:
+			a := m.address(in.imm, 4)
+			m.push32(binary.LittleEndian.Uint32(m.memory[a:]))
+		case 0x29:
+			a := m.address(in.imm, 8)
+			m.push(binary.LittleEndian.Uint64(m.memory[a:]))
+		case 0x2A:
+			a := m.address(in.imm, 4)
+			m.push32(binary.LittleEndian.Uint32(m.memory[a:]))
+		case 0x2B:
+			a := m.address(in.imm, 8)
+			m.push(binary.LittleEndian.Uint64(m.memory[a:]))
+		case 0x2C:
+			a := m.address(in.imm, 1)
+			m.push32(uint32(int32(int8(m.memory[a]))))
+		case 0x2D:
+			a := m.address(in.imm, 1)
+			m.push32(uint32(m.memory[a]))
+		case 0x2E:
+			a := m.address(in.imm, 2)
+			m.push32(uint32(int32(int16(binary.LittleEndian.Uint16(m.memory[a:])))))
+		case 0x2F:
+			a := m.address(in.imm, 2)
+			m.push32(uint32(binary.LittleEndian.Uint16(m.memory[a:])))
+		case 0x30:
+			a := m.address(in.imm, 1)
+			m.push(uint64(int64(int8(m.memory[a]))))
+		case 0x31:
+			a := m.address(in.imm, 1)
+			m.push(uint64(m.memory[a]))
+		case 0x32:
+			a := m.address(in.imm, 2)
+			m.push(uint64(int64(int16(binary.LittleEndian.Uint16(m.memory[a:])))))
+		case 0x33:
+			a := m.address(in.imm, 2)
+			m.push(uint64(binary.LittleEndian.Uint16(m.memory[a:])))
+		case 0x34:
+			a := m.address(in.imm, 4)
+			m.push(uint64(int64(int32(binary.LittleEndian.Uint32(m.memory[a:])))))
+		case 0x35:
+			a := m.address(in.imm, 4)
+			m.push(uint64(binary.LittleEndian.Uint32(m.memory[a:])))
+		case 0x36, 0x38:
+			v := m.pop32()
+			a := m.address(in.imm, 4)
+			binary.LittleEndian.PutUint32(m.memory[a:], v)
+		case 0x37, 0x39:
+			v := m.pop()
+			a := m.address(in.imm, 8)
+			binary.LittleEndian.PutUint64(m.memory[a:], v)
+		case 0x3A, 0x3C:
+			v := m.pop()
+			a := m.address(in.imm, 1)
+			m.memory[a] = byte(v)
+		case 0x3B, 0x3D:
+			v := m.pop()
+			a := m.address(in.imm, 2)
+			binary.LittleEndian.PutUint16(m.memory[a:], uint16(v))
+		case 0x3E:
+			v := m.pop()
+			a := m.address(in.imm, 4)
+			binary.LittleEndian.PutUint32(m.memory[a:], uint32(v))
+		case 0x3F:
+			m.push32(uint32(len(m.memory) / pageSize))
+		case 0x40:
+			n := m.pop32()
+			pages := uint32(len(m.memory) / pageSize)
+			if !m.module.memory || uint64(pages)+uint64(n) > uint64(m.maxPages) {
+				m.push32(math.MaxUint32)
+			} else {
+				m.memory = append(m.memory, make([]byte, int(n)*pageSize)...)
+				m.push32(pages)
+			}
+		case 0x41, 0x42, 0x43, 0x44:
+			m.push(in.imm)
+		case 0xD0:
+			m.push(0)
+		case 0xD1:
+			m.pushBool(m.pop() == 0)
+		case 0xD2:
+			m.push(in.imm + 1)
+		default:
+			if in.op >= 0xFC00 {
+				m.bulk(in)
+			} else if in.op < 0x8B {
+				m.integer(in.op)
+			} else {
+				m.float(in.op)
+			}
+		}
+		pc++
+	}
+	copy(m.stack[base:], m.stack[len(m.stack)-arity:])
+	m.stack = m.stack[:base+arity]
+}
+
+func (m *machine) table(index uint32) []uint64 {
+	if int(index) >= len(m.tables) {
+		fail("undefined table")
+	}
+	return m.tables[index]
+}
+
+func (m *machine) integer(op uint16) {
+	switch {
+	case op == 0x45:
+		m.pushBool(m.pop32() == 0)
+	case op >= 0x46 && op <= 0x4F:
+		b := m.pop32()
+		a := m.pop32()
+		switch op {
+		case 0x46:
+			m.pushBool(a == b)
+		case 0x47:
+			m.pushBool(a != b)
+		case 0x48:
+			m.pushBool(int32(a) < int32(b))
+		case 0x49:
+			m.pushBool(a < b)
+		case 0x4A:
+			m.pushBool(int32(a) > int32(b))
+		case 0x4B:
+			m.pushBool(a > b)
+		case 0x4C:
+			m.pushBool(int32(a) <= int32(b))
+		case 0x4D:
+			m.pushBool(a <= b)
+		case 0x4E:
+			m.pushBool(int32(a) >= int32(b))
+		case 0x4F:
+			m.pushBool(a >= b)
+		}
+	case op == 0x50:
+		m.pushBool(m.pop() == 0)
+	case op >= 0x51 && op <= 0x5A:
+		b := m.pop()
+		a := m.pop()
+		switch op {
+		case 0x51:
+			m.pushBool(a == b)
+		case 0x52:
+			m.pushBool(a != b)
+		case 0x53:
+			m.pushBool(int64(a) < int64(b))
+		case 0x54:
+			m.pushBool(a < b)
+		case 0x55:
+			m.pushBool(int64(a) > int64(b))
+		case 0x56:
+			m.pushBool(a > b)
+		case 0x57:
+			m.pushBool(int64(a) <= int64(b))
+		case 0x58:
+			m.pushBool(a <= b)
+		case 0x59:
+			m.pushBool(int64(a) >= int64(b))
+		case 0x5A:
+			m.pushBool(a >= b)
+		}
+	case op >= 0x5B && op <= 0x60:
+		b := m.popF32()
+		a := m.popF32()
+		m.pushBool(compare(op-0x5B, float64(a), float64(b)))
+	case op >= 0x61 && op <= 0x66:
+		b := m.popF64()
+		a := m.popF64()
+		m.pushBool(compare(op-0x61, a, b))
+	case op >= 0x67 && op <= 0x69:
+		a := m.pop32()
+		switch op {
+		case 0x67:
+			m.push32(uint32(bits.LeadingZeros32(a)))
+		case 0x68:
+			m.push32(uint32(bits.TrailingZeros32(a)))
+		case 0x69:
+			m.push32(uint32(bits.OnesCount32(a)))
+		}
+	case op >= 0x6A && op <= 0x78:
+		b := m.pop32()
+		a := m.pop32()
+		m.push32(binary32(op, a, b))
+	case op >= 0x79 && op <= 0x7B:
+		a := m.pop()
+		switch op {
+		case 0x79:
+			m.push(uint64(bits.LeadingZeros64(a)))
+		case 0x7A:
+			m.push(uint64(bits.TrailingZeros64(a)))
+		case 0x7B:
+			m.push(uint64(bits.OnesCount64(a)))
+		}
+	case op >= 0x7C && op <= 0x8A:
+		b := m.pop()
+		a := m.pop()
+		m.push(binary64(op, a, b))
+	}
+}
+
+func compare(op uint16, a float64, b float64) bool {
+	switch op {
+	case 0:
+		return a == b
+	case 1:
+		return a != b
+	case 2:
+		return a < b
+	case 3:
+		return a > b
+	case 4:
+		return a <= b
+	}
+	return a >= b
+}
+
+func binary32(op uint16, a uint32, b uint32) uint32 {
+	switch op {
+	case 0x6A:
+		return a + b
+	case 0x6B:
+		return a - b
+	case 0x6C:
+		return a * b
+	case 0x6D:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		if int32(a) == math.MinInt32 && int32(b) == -1 {
+			fail("integer overflow")
+		}
+		return uint32(int32(a) / int32(b))
+	case 0x6E:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		return a / b
+	case 0x6F:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		if int32(b) == -1 {
+			return 0
+		}
+		return uint32(int32(a) % int32(b))
+	case 0x70:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		return a % b
+	case 0x71:
+		return a & b
+	case 0x72:
+		return a | b
+	case 0x73:
+		return a ^ b
+	case 0x74:
+		return a << (b & 31)
+	case 0x75:
+		return uint32(int32(a) >> (b & 31))
+	case 0x76:
+		return a >> (b & 31)
+	case 0x77:
+		return bits.RotateLeft32(a, int(b&31))
+	}
+	return bits.RotateLeft32(a, -int(b&31))
+}
+
+func binary64(op uint16, a uint64, b uint64) uint64 {
+	switch op {
+	case 0x7C:
+		return a + b
+	case 0x7D:
+		return a - b
+	case 0x7E:
+		return a * b
+	case 0x7F:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			fail("integer overflow")
+		}
+		return uint64(int64(a) / int64(b))
+	case 0x80:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		return a / b
+	case 0x81:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		if int64(b) == -1 {
+			return 0
+		}
+		return uint64(int64(a) % int64(b))
+	case 0x82:
+		if b == 0 {
+			fail("integer divide by zero")
+		}
+		return a % b
+	case 0x83:
+		return a & b
+	case 0x84:
+		return a | b
+	case 0x85:
+		return a ^ b
+	case 0x86:
+		return a << (b & 63)
+	case 0x87:
+		return uint64(int64(a) >> (b & 63))
+	case 0x88:
+		return a >> (b & 63)
+	case 0x89:
+		return bits.RotateLeft64(a, int(b&63))
+	}
+	return bits.RotateLeft64(a, -int(b&63))
+}
+
+func (m *machine) float(op uint16) {
+	switch {
+	case op >= 0x8B && op <= 0x91:
+		a := m.pop32()
+		switch op {
+		case 0x8B:
+			m.push32(a &^ (1 << 31))
+		case 0x8C:
+			m.push32(a ^ (1 << 31))
+		default:
+			m.pushF32(float32(unary(op-0x8B, float64(math.Float32frombits(a)))))
+		}
+	case op >= 0x92 && op <= 0x98:
+		b := m.popF32()
+		a := m.popF32()
+		switch op {
+		case 0x92:
+			m.pushF32(a + b)
+		case 0x93:
+			m.pushF32(a - b)
+		case 0x94:
+			m.pushF32(a * b)
+		case 0x95:
+			m.pushF32(a / b)
+		case 0x98:
+			m.push32(math.Float32bits(a)&^(1<<31) | math.Float32bits(b)&(1<<31))
+		default:
+			m.pushF32(float32(minMax(op-0x96, float64(a), float64(b))))
+		}
+	case op >= 0x99 && op <= 0x9F:
+		a := m.pop()
+		switch op {
+		case 0x99:
+			m.push(a &^ (1 << 63))
+		case 0x9A:
+			m.push(a ^ (1 << 63))
+		default:
+			m.pushF64(unary(op-0x99, math.Float64frombits(a)))
+		}
+	case op >= 0xA0 && op <= 0xA6:
+		b := m.popF64()
+		a := m.popF64()
+		switch op {
+		case 0xA0:
+			m.pushF64(a + b)
+		case 0xA1:
+			m.pushF64(a - b)
+		case 0xA2:
+			m.pushF64(a * b)
+		case 0xA3:
+			m.pushF64(a / b)
+		case 0xA6:
+			m.pushF64(math.Copysign(a, b))
+		default:
+			m.pushF64(minMax(op-0xA4, a, b))
+		}
+	default:
+		m.convert(op)
+	}
+}
+
+func unary(op uint16, a float64) float64 {
+	switch op {
+	case 2:
+		return math.Ceil(a)
+	case 3:
+		return math.Floor(a)
+	case 4:
+		return math.Trunc(a)
+	case 5:
+		return math.RoundToEven(a)
+	}
+	return math.Sqrt(a)
+}
+
+// minMax follows wasm, where NaN wins, and negative zero is less than positive zero.
+func minMax(op uint16, a float64, b float64) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.NaN()
+	}
+	if a == 0 && b == 0 {
+		if (op == 0) == math.Signbit(a) {
+			return a
+		}
+		return b
+	}
+	if (op == 0) == (a < b) {
+		return a
+	}
+	return b
+}
+
+// truncate converts a float to an integer in the range, and it traps or saturates outside of it.
+func truncate(f float64, min float64, max float64, saturate bool) float64 {
+	if math.IsNaN(f) {
+		if saturate {
+			return 0
+		}
+		fail("invalid conversion to integer")
+	}
+	t := math.Trunc(f)
+	if t < min || t >= max {
+		if !saturate {
+			fail("integer overflow")
+		}
+		if t < min {
+			return min
+		}
+		return max
+	}
+	return t
+}
+
+const two31 = 2147483648.0
+const two32 = 4294967296.0
+const two63 = 9223372036854775808.0
+const two64 = 18446744073709551616.0
+
+func (m *machine) truncateTo(op uint16, f float64, saturate bool) {
+	switch op {
+	case 0:
+		t := truncate(f, -two31, two31, saturate)
+		if t >= two31 {
+			m.push32(math.MaxInt32)
+		} else {
+			m.push32(uint32(int32(t)))
+		}
+	case 1:
+		t := truncate(f, 0, two32, saturate)
+		if t >= two32 {
+			m.push32(math.MaxUint32)
+		} else {
+			m.push32(uint32(t))
+		}
+	case 2:
+		t := truncate(f, -two63, two63, saturate)
+		if t >= two63 {
+			m.push(math.MaxInt64)
+		} else {
+			m.push(uint64(int64(t)))
+		}
+	default:
+		t := truncate(f, 0, two64, saturate)
+		if t >= two64 {
+			m.push(math.MaxUint64)
+		} else {
+			m.push(uint64(t))
+		}
+	}
+}
+
+func (m *machine) convert(op uint16) {
+	switch op {
+	case 0xA7:
+		m.push32(m.pop32())
+	case 0xA8:
+		m.truncateTo(0, float64(m.popF32()), false)
+	case 0xA9:
+		m.truncateTo(1, float64(m.popF32()), false)
+	case 0xAA:
+		m.truncateTo(0, m.popF64(), false)
+	case 0xAB:
+		m.truncateTo(1, m.popF64(), false)
+	case 0xAC:
+		m.push(uint64(int64(int32(m.pop32()))))
+	case 0xAD:
+		m.push(uint64(m.pop32()))
+	case 0xAE:
+		m.truncateTo(2, float64(m.popF32()), false)
+	case 0xAF:
+		m.truncateTo(3, float64(m.popF32()), false)
+	case 0xB0:
+		m.truncateTo(2, m.popF64(), false)
+	case 0xB1:
+		m.truncateTo(3, m.popF64(), false)
+	case 0xB2:
+		m.pushF32(float32(int32(m.pop32())))
+	case 0xB3:
+		m.pushF32(float32(m.pop32()))
+	case 0xB4:
+		m.pushF32(float32(int64(m.pop())))
+	case 0xB5:
+		m.pushF32(float32(m.pop()))
+	case 0xB6:
+		m.pushF32(float32(m.popF64()))
+	case 0xB7:
+		m.pushF64(float64(int32(m.pop32())))
+	case 0xB8:
+		m.pushF64(float64(m.pop32()))
+	case 0xB9:
+		m.pushF64(float64(int64(m.pop())))
+	case 0xBA:
+		m.pushF64(float64(m.pop()))
+	case 0xBB:
+		m.pushF64(float64(m.popF32()))
+	case 0xBC, 0xBD, 0xBE, 0xBF:
+		// Reinterpretations keep the bits.
+	case 0xC0:
+		m.push32(uint32(int32(int8(m.pop32()))))
+	case 0xC1:
+		m.push32(uint32(int32(int16(m.pop32()))))
+	case 0xC2:
+		m.push(uint64(int64(int8(m.pop()))))
+	case 0xC3:
+		m.push(uint64(int64(int16(m.pop()))))
+	case 0xC4:
+		m.push(uint64(int64(int32(m.pop()))))
+	}
+}
+
+// bulk runs the saturating conversions, and the bulk memory and table instructions.
+func (m *machine) bulk(in *instr) {
+	sub := in.op & 0xFF
+	switch sub {
+	case 0, 1:
+		m.truncateTo(sub&1, float64(m.popF32()), true)
+	case 2, 3:
+		m.truncateTo(sub&1, m.popF64(), true)
+	case 4, 5:
+		m.truncateTo(2+sub&1, float64(m.popF32()), true)
+	case 6, 7:
+		m.truncateTo(2+sub&1, m.popF64(), true)
+	case 8:
+		n, s, d := m.pop32(), m.pop32(), m.pop32()
+		segment := m.module.data[in.imm].bytes
+		if m.dropped[fmt.Sprintf("data %d", in.imm)] {
+			segment = nil
+		}
+		m.checkRange(s, n, len(segment))
+		m.checkRange(d, n, len(m.memory))
+		copy(m.memory[d:], segment[s:s+n])
+	case 9:
+		m.dropped[fmt.Sprintf("data %d", in.imm)] = true
+	case 10:
+		n, s, d := m.pop32(), m.pop32(), m.pop32()
+		m.checkRange(s, n, len(m.memory))
+		m.checkRange(d, n, len(m.memory))
+		copy(m.memory[d:d+n], m.memory[s:s+n])
+	case 11:
+		n, v, d := m.pop32(), m.pop32(), m.pop32()
+		m.checkRange(d, n, len(m.memory))
+		for i := d; i < d+n; i++ {
+			m.memory[i] = byte(v)
+		}
+	case 12:
+		n, s, d := m.pop32(), m.pop32(), m.pop32()
+		refs := m.elementRefs(uint32(in.imm))
+		t := m.table(in.imm2)
+		if uint64(s)+uint64(n) > uint64(len(refs)) || uint64(d)+uint64(n) > uint64(len(t)) {
+			fail("out of bounds table access")
+		}
+		copy(t[d:], refs[s:s+n])
+	case 13:
+		m.dropped[fmt.Sprintf("elem %d", in.imm)] = true
+	case 14:
+		n, s, d := m.pop32(), m.pop32(), m.pop32()
+		dst, src := m.table(uint32(in.imm)), m.table(in.imm2)
+		if uint64(s)+uint64(n) > uint64(len(src)) || uint64(d)+uint64(n) > uint64(len(dst)) {
+			fail("out of bounds table access")
+		}
+		copy(dst[d:d+n], src[s:s+n])
+	case 15:
+		n := m.pop32()
+		v := m.pop()
+		t := m.table(uint32(in.imm))
+		size := uint32(len(t))
+		if uint64(size)+uint64(n) > uint64(m.module.tables[in.imm].max) || uint64(size)+uint64(n) > maxTableSize {
+			m.push32(math.MaxUint32)
+			return
+		}
+		for i := uint32(0); i < n; i++ {
+			t = append(t, v)
+		}
+		m.tables[in.imm] = t
+		m.push32(size)
+	case 16:
+		m.push32(uint32(len(m.table(uint32(in.imm)))))
+	case 17:
+		n := m.pop32()
+		v := m.pop()
+		d := m.pop32()
+		t := m.table(uint32(in.imm))
+		if uint64(d)+uint64(n) > uint64(len(t)) {
+			fail("out of bounds table access")
+		}
+		for i := d; i < d+n; i++ {
+			t[i] = v
+		}
+	}
+}
+
+const maxTableSize = 1 << 20
+
+// elementRefs evaluates the references of an element segment. Dropped segments are empty.
+func (m *machine) elementRefs(index uint32) []uint64 {
+	if int(index) >= len(m.module.elements) || m.dropped[fmt.Sprintf("elem %d", index)] {
+		return nil
+	}
+	refs := make([]uint64, 0)
+	for _, ref := range m.module.elements[index].refs {
+		refs = append(refs, m.evaluate(ref))
+	}
+	return refs
+}
+
+// evaluate runs a constant expression of a global, offset or element.
+func (m *machine) evaluate(code []instr) uint64 {
+	m.execute(code, nil, 1)
+	return m.pop()
+}
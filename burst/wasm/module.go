@@ -0,0 +1,484 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// This is a decoder of WebAssembly binary modules.
+// It supports the MVP with mutable globals, sign extension, saturating conversions, bulk memory and reference types.
+// SIMD, threads and multiple memories are not supported.
+// Function bodies are decoded once into instructions with their branch targets.
+
+const (
+	typeI32       = 0x7F
+	typeI64       = 0x7E
+	typeF32       = 0x7D
+	typeF64       = 0x7C
+	typeFuncref   = 0x70
+	typeExternref = 0x6F
+)
+
+const pageSize = 65536
+const maxPages = 65536
+
+var errMalformed = errors.New("malformed wasm module")
+
+type funcType struct {
+	params  []byte
+	results []byte
+}
+
+func (t funcType) equals(u funcType) bool {
+	return bytes.Equal(t.params, u.params) && bytes.Equal(t.results, u.results)
+}
+
+type function struct {
+	typ    uint32
+	locals int
+	code   []instr
+	module string
+	name   string
+	host   func(m *machine, args []uint64) []uint64
+}
+
+type global struct {
+	typ     byte
+	mutable bool
+	init    []instr
+}
+
+type table struct {
+	min uint32
+	max uint32
+}
+
+type element struct {
+	mode   byte
+	table  uint32
+	offset []instr
+	refs   [][]instr
+}
+
+type data struct {
+	active bool
+	offset []instr
+	bytes  []byte
+}
+
+type export struct {
+	kind  byte
+	index uint32
+}
+
+type module struct {
+	types     []funcType
+	functions []*function
+	tables    []table
+	memory    bool
+	memoryMin uint32
+	memoryMax uint32
+	globals   []global
+	exports   map[string]export
+	start     int64
+	elements  []element
+	data      []data
+}
+
+const (
+	elementActive = iota
+	elementPassive
+	elementDeclarative
+)
+
+// instr is a decoded instruction. Blocks know their end and else, and br_table keeps its labels.
+type instr struct {
+	op      uint16
+	imm     uint64
+	imm2    uint32
+	end     int32
+	els     int32
+	params  uint16
+	results uint16
+	labels  []uint32
+}
+
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) byte() byte {
+	if r.pos >= len(r.b) {
+		panic(errMalformed)
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) bytes(n uint32) []byte {
+	if uint64(r.pos)+uint64(n) > uint64(len(r.b)) {
+		panic(errMalformed)
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *reader) uleb(bits uint) uint64 {
+	result := uint64(0)
+	shift := uint(0)
+	for {
+		b := r.byte()
+		result |= uint64(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+		if shift >= bits {
+			panic(errMalformed)
+		}
+	}
+	return result
+}
+
+func (r *reader) sleb(bits uint) int64 {
+	result := int64(0)
+	shift := uint(0)
+	for {
+		b := r.byte()
+		result |= int64(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			break
+		}
+		if shift >= bits {
+			panic(errMalformed)
+		}
+	}
+	return result
+}
+
+func (r *reader) u32() uint32 {
+	v := r.uleb(32)
+	if v > math.MaxUint32 {
+		panic(errMalformed)
+	}
+	return uint32(v)
+}
+
+func (r *reader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *reader) valueTypes() []byte {
+	n := r.u32()
+	ret := make([]byte, 0)
+	for i := uint32(0); i < n; i++ {
+		ret = append(ret, r.valueType())
+	}
+	return ret
+}
+
+func (r *reader) valueType() byte {
+	t := r.byte()
+	switch t {
+	case typeI32, typeI64, typeF32, typeF64, typeFuncref, typeExternref:
+		return t
+	}
+	panic(fmt.Errorf("value type %#x is not supported", t))
+}
+
+func (r *reader) limits() (uint32, uint32) {
+	flags := r.byte()
+	min := r.u32()
+	max := uint32(math.MaxUint32)
+	if flags&1 != 0 {
+		max = r.u32()
+	}
+	if flags > 1 {
+		panic(errors.New("shared memory is not supported"))
+	}
+	return min, max
+}
+
+// decode parses a binary module. Malformed modules return an error, they never panic.
+func decode(code []byte) (m *module, err error) {
+	defer func() {
+		failure := recover()
+		if failure != nil {
+			m = nil
+			err = errMalformed
+			e, ok := failure.(error)
+			_, crashed := failure.(runtime.Error)
+			if ok && !crashed {
+				err = e
+			}
+		}
+	}()
+	r := &reader{b: code}
+	if !bytes.Equal(r.bytes(4), []byte("\x00asm")) || !bytes.Equal(r.bytes(4), []byte{1, 0, 0, 0}) {
+		return nil, errors.New("not a wasm module")
+	}
+	m = &module{exports: map[string]export{}, start: -1}
+	functionTypes := make([]uint32, 0)
+	imports := 0
+	for r.pos < len(r.b) {
+		id := r.byte()
+		section := &reader{b: r.bytes(r.u32())}
+		switch id {
+		case 0:
+			// Custom sections like names and debug information are skipped.
+		case 1:
+			for n := section.u32(); n > 0; n-- {
+				if section.byte() != 0x60 {
+					panic(errMalformed)
+				}
+				m.types = append(m.types, funcType{params: section.valueTypes(), results: section.valueTypes()})
+			}
+		case 2:
+			for n := section.u32(); n > 0; n-- {
+				moduleName, name := section.name(), section.name()
+				kind := section.byte()
+				if kind != 0 {
+					panic(fmt.Errorf("import %s.%s is not a function", moduleName, name))
+				}
+				m.functions = append(m.functions, &function{typ: section.u32(), module: moduleName, name: name})
+				imports++
+			}
+		case 3:
+			for n := section.u32(); n > 0; n-- {
+				functionTypes = append(functionTypes, section.u32())
+			}
+		case 4:
+			for n := section.u32(); n > 0; n-- {
+				section.valueType()
+				min, max := section.limits()
+				m.tables = append(m.tables, table{min: min, max: max})
+			}
+		case 5:
+			n := section.u32()
+			if n > 1 {
+				panic(errors.New("multiple memories are not supported"))
+			}
+			if n == 1 {
+				m.memory = true
+				m.memoryMin, m.memoryMax = section.limits()
+			}
+		case 6:
+			for n := section.u32(); n > 0; n-- {
+				typ := section.valueType()
+				mutable := section.byte() == 1
+				m.globals = append(m.globals, global{typ: typ, mutable: mutable, init: decodeCode(section, m)})
+			}
+		case 7:
+			for n := section.u32(); n > 0; n-- {
+				name := section.name()
+				m.exports[name] = export{kind: section.byte(), index: section.u32()}
+			}
+		case 8:
+			m.start = int64(section.u32())
+		case 9:
+			for n := section.u32(); n > 0; n-- {
+				m.elements = append(m.elements, decodeElement(section, m))
+			}
+		case 10:
+			n := section.u32()
+			if int(n) != len(functionTypes) {
+				panic(errMalformed)
+			}
+			for i := uint32(0); i < n; i++ {
+				body := &reader{b: section.bytes(section.u32())}
+				locals := uint64(0)
+				for groups := body.u32(); groups > 0; groups-- {
+					locals += uint64(body.u32())
+					body.valueType()
+					if locals > 50000 {
+						panic(errors.New("too many locals"))
+					}
+				}
+				m.functions = append(m.functions, &function{typ: functionTypes[i], locals: int(locals), code: decodeCode(body, m)})
+			}
+		case 11:
+			for n := section.u32(); n > 0; n-- {
+				segment := data{}
+				flags := section.u32()
+				if flags == 2 {
+					section.u32()
+				}
+				if flags != 1 {
+					segment.active = true
+					segment.offset = decodeCode(section, m)
+				}
+				segment.bytes = section.bytes(section.u32())
+				m.data = append(m.data, segment)
+			}
+		case 12:
+			section.u32()
+		default:
+			panic(fmt.Errorf("section %d is not supported", id))
+		}
+	}
+	if len(m.functions) != imports+len(functionTypes) {
+		panic(errMalformed)
+	}
+	for _, f := range m.functions {
+		if int(f.typ) >= len(m.types) {
+			panic(errMalformed)
+		}
+	}
+	return m, nil
+}
+
+func decodeElement(r *reader, m *module) element {
+	flags := r.u32()
+	e := element{mode: elementActive}
+	if flags&1 != 0 {
+		e.mode = elementPassive
+		if flags&2 != 0 {
+			e.mode = elementDeclarative
+		}
+	}
+	if flags&1 == 0 {
+		if flags&2 != 0 {
+			e.table = r.u32()
+		}
+		e.offset = decodeCode(r, m)
+	}
+	if flags&3 != 0 {
+		// Element kind or reference type
+		r.byte()
+	}
+	for n := r.u32(); n > 0; n-- {
+		if flags&4 != 0 {
+			e.refs = append(e.refs, decodeCode(r, m))
+		} else {
+			e.refs = append(e.refs, []instr{{op: 0xD2, imm: uint64(r.u32())}, {op: 0x0B}})
+		}
+	}
+	return e
+}
+
+func decodeBlockType(r *reader, m *module, in *instr) {
+	b := r.b[r.pos]
+	if b == 0x40 {
+		r.pos++
+		return
+	}
+	if b == typeI32 || b == typeI64 || b == typeF32 || b == typeF64 || b == typeFuncref || b == typeExternref {
+		r.pos++
+		in.results = 1
+		return
+	}
+	index := r.sleb(33)
+	if index < 0 || index >= int64(len(m.types)) {
+		panic(errMalformed)
+	}
+	in.params = uint16(len(m.types[index].params))
+	in.results = uint16(len(m.types[index].results))
+}
+
+// decodeCode decodes instructions up to the end of the function or the constant expression.
+func decodeCode(r *reader, m *module) []instr {
+	code := make([]instr, 0)
+	blocks := make([]int, 0)
+	for {
+		in := instr{op: uint16(r.byte()), end: -1, els: -1}
+		switch in.op {
+		case 0x02, 0x03, 0x04:
+			decodeBlockType(r, m, &in)
+			blocks = append(blocks, len(code))
+		case 0x05:
+			if len(blocks) == 0 || code[blocks[len(blocks)-1]].op != 0x04 {
+				panic(errMalformed)
+			}
+			code[blocks[len(blocks)-1]].els = int32(len(code))
+		case 0x0B:
+			if len(blocks) == 0 {
+				code = append(code, in)
+				return code
+			}
+			opener := blocks[len(blocks)-1]
+			blocks = blocks[:len(blocks)-1]
+			code[opener].end = int32(len(code))
+			if code[opener].els >= 0 {
+				code[code[opener].els].end = int32(len(code))
+			}
+		case 0x0C, 0x0D, 0x10, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0xD2:
+			in.imm = uint64(r.u32())
+		case 0x0E:
+			for n := r.u32(); n > 0; n-- {
+				in.labels = append(in.labels, r.u32())
+			}
+			in.labels = append(in.labels, r.u32())
+		case 0x11:
+			in.imm = uint64(r.u32())
+			in.imm2 = r.u32()
+			if in.imm >= uint64(len(m.types)) {
+				panic(errMalformed)
+			}
+		case 0x1C:
+			r.valueTypes()
+			in.op = 0x1B
+		case 0x3F, 0x40:
+			r.byte()
+		case 0x41:
+			in.imm = uint64(uint32(int32(r.sleb(32))))
+		case 0x42:
+			in.imm = uint64(r.sleb(64))
+		case 0x43:
+			b := r.bytes(4)
+			in.imm = uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24
+		case 0x44:
+			b := r.bytes(8)
+			for i := 7; i >= 0; i-- {
+				in.imm = in.imm<<8 | uint64(b[i])
+			}
+		case 0xD0:
+			r.byte()
+		case 0xFC:
+			sub := r.u32()
+			in.op = 0xFC00 | uint16(sub)
+			switch sub {
+			case 0, 1, 2, 3, 4, 5, 6, 7:
+			case 8:
+				in.imm = uint64(r.u32())
+				r.byte()
+			case 9, 13, 15, 16, 17:
+				in.imm = uint64(r.u32())
+			case 10:
+				r.byte()
+				r.byte()
+			case 11:
+				r.byte()
+			case 12, 14:
+				in.imm = uint64(r.u32())
+				in.imm2 = r.u32()
+			default:
+				panic(fmt.Errorf("instruction 0xFC %d is not supported", sub))
+			}
+		default:
+			if in.op >= 0x28 && in.op <= 0x3E {
+				r.u32()
+				in.imm = uint64(r.u32())
+			} else if !(in.op <= 0x01 || in.op == 0x0F || in.op == 0x1A || in.op == 0x1B || (in.op >= 0x45 && in.op <= 0xC4) || in.op == 0xD1) {
+				panic(fmt.Errorf("instruction %#x is not supported", in.op))
+			}
+		}
+		code = append(code, in)
+	}
+}
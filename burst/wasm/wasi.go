@@ -0,0 +1,248 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"io"
+	"math/rand"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// This is the WASI preview 1 system interface of modules.
+// Standard input is the input of the burst, and standard output is the result.
+// There are no files, sockets or environment variables. The only argument is the name burst.
+// The clock and the random generator are deterministic, so that the same input gives the same output.
+
+const (
+	errnoSuccess = 0
+	errnoBadf    = 8
+	errnoNosys   = 52
+	errnoSpipe   = 70
+)
+
+type host struct {
+	stdin  io.Reader
+	stdout *limitedBuffer
+	stderr *limitedBuffer
+	random *rand.Rand
+	fuel   int64
+}
+
+// limitedBuffer keeps the output up to the limit, and it traps the burst, when it writes more.
+// The output is written to the target instead, if it is set.
+type limitedBuffer struct {
+	bytes.Buffer
+	target io.Writer
+	left   int64
+}
+
+func (b *limitedBuffer) write(p []byte) {
+	var target io.Writer = &b.Buffer
+	if b.target != nil {
+		target = b.target
+	}
+	if int64(len(p)) > b.left {
+		_, _ = target.Write(p[:b.left])
+		b.left = 0
+		panic(sandbox.ErrOutputLimit)
+	}
+	b.left = b.left - int64(len(p))
+	_, err := target.Write(p)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (m *machine) checkMemory(offset uint32, length uint32) {
+	if uint64(offset)+uint64(length) > uint64(len(m.memory)) {
+		panic(trap{message: "out of bounds memory access"})
+	}
+}
+
+func (m *machine) u32At(offset uint32) uint32 {
+	m.checkMemory(offset, 4)
+	return binary.LittleEndian.Uint32(m.memory[offset:])
+}
+
+func (m *machine) putU32(offset uint32, v uint32) {
+	m.checkMemory(offset, 4)
+	binary.LittleEndian.PutUint32(m.memory[offset:], v)
+}
+
+func (m *machine) putU64(offset uint32, v uint64) {
+	m.checkMemory(offset, 8)
+	binary.LittleEndian.PutUint64(m.memory[offset:], v)
+}
+
+// iovecs returns the buffers of fd_read and fd_write.
+func (m *machine) iovecs(iovs uint32, count uint32) [][]byte {
+	ret := make([][]byte, 0)
+	for i := uint32(0); i < count; i++ {
+		offset, length := m.u32At(iovs+8*i), m.u32At(iovs+8*i+4)
+		m.checkMemory(offset, length)
+		ret = append(ret, m.memory[offset:offset+length])
+	}
+	return ret
+}
+
+func result(errno uint64) []uint64 {
+	return []uint64{errno}
+}
+
+var wasi = map[string]func(m *machine, args []uint64) []uint64{
+	"fd_write": func(m *machine, args []uint64) []uint64 {
+		var out *limitedBuffer
+		switch args[0] {
+		case 1:
+			out = m.host.stdout
+		case 2:
+			out = m.host.stderr
+		default:
+			return result(errnoBadf)
+		}
+		written := uint32(0)
+		for _, iov := range m.iovecs(uint32(args[1]), uint32(args[2])) {
+			out.write(iov)
+			written = written + uint32(len(iov))
+		}
+		m.putU32(uint32(args[3]), written)
+		return result(errnoSuccess)
+	},
+	"fd_read": func(m *machine, args []uint64) []uint64 {
+		if args[0] != 0 {
+			return result(errnoBadf)
+		}
+		read := uint32(0)
+		for _, iov := range m.iovecs(uint32(args[1]), uint32(args[2])) {
+			n, _ := m.host.stdin.Read(iov)
+			read = read + uint32(n)
+			if n < len(iov) {
+				break
+			}
+		}
+		m.putU32(uint32(args[3]), read)
+		return result(errnoSuccess)
+	},
+	"fd_close": func(m *machine, args []uint64) []uint64 {
+		if args[0] > 2 {
+			return result(errnoBadf)
+		}
+		return result(errnoSuccess)
+	},
+	"fd_seek": func(m *machine, args []uint64) []uint64 {
+		if args[0] > 2 {
+			return result(errnoBadf)
+		}
+		return result(errnoSpipe)
+	},
+	"fd_fdstat_get": func(m *machine, args []uint64) []uint64 {
+		if args[0] > 2 {
+			return result(errnoBadf)
+		}
+		// Character devices with the rights to read and write
+		m.checkMemory(uint32(args[1]), 24)
+		copy(m.memory[args[1]:args[1]+24], make([]byte, 24))
+		m.memory[args[1]] = 2
+		m.putU64(uint32(args[1])+8, 0x42)
+		m.putU64(uint32(args[1])+16, 0x42)
+		return result(errnoSuccess)
+	},
+	"fd_prestat_get": func(m *machine, args []uint64) []uint64 {
+		return result(errnoBadf)
+	},
+	"fd_prestat_dir_name": func(m *machine, args []uint64) []uint64 {
+		return result(errnoBadf)
+	},
+	"args_sizes_get": func(m *machine, args []uint64) []uint64 {
+		m.putU32(uint32(args[0]), 1)
+		m.putU32(uint32(args[1]), uint32(len("burst\x00")))
+		return result(errnoSuccess)
+	},
+	"args_get": func(m *machine, args []uint64) []uint64 {
+		m.putU32(uint32(args[0]), uint32(args[1]))
+		m.checkMemory(uint32(args[1]), uint32(len("burst\x00")))
+		copy(m.memory[args[1]:], "burst\x00")
+		return result(errnoSuccess)
+	},
+	"environ_sizes_get": func(m *machine, args []uint64) []uint64 {
+		m.putU32(uint32(args[0]), 0)
+		m.putU32(uint32(args[1]), 0)
+		return result(errnoSuccess)
+	},
+	"environ_get": func(m *machine, args []uint64) []uint64 {
+		return result(errnoSuccess)
+	},
+	"clock_res_get": func(m *machine, args []uint64) []uint64 {
+		m.putU64(uint32(args[1]), 1)
+		return result(errnoSuccess)
+	},
+	"clock_time_get": func(m *machine, args []uint64) []uint64 {
+		// The clock ticks a nanosecond with each instruction run.
+		m.putU64(uint32(args[2]), uint64(m.host.fuel-m.fuel))
+		return result(errnoSuccess)
+	},
+	"random_get": func(m *machine, args []uint64) []uint64 {
+		m.checkMemory(uint32(args[0]), uint32(args[1]))
+		_, _ = m.host.random.Read(m.memory[args[0] : args[0]+args[1]])
+		return result(errnoSuccess)
+	},
+	"sched_yield": func(m *machine, args []uint64) []uint64 {
+		return result(errnoSuccess)
+	},
+	"proc_exit": func(m *machine, args []uint64) []uint64 {
+		panic(exit{code: uint32(args[0])})
+	},
+	"proc_raise": func(m *machine, args []uint64) []uint64 {
+		panic(trap{message: "signal raised"})
+	},
+}
+
+// link resolves the imports of a module. Unknown WASI functions return ENOSYS, if they return an errno.
+func link(m *module) error {
+	for _, f := range m.functions {
+		if f.module == "" {
+			continue
+		}
+		if f.module != "wasi_snapshot_preview1" && f.module != "wasi_unstable" {
+			return fmt.Errorf("import %s.%s is not supported", f.module, f.name)
+		}
+		t := m.types[f.typ]
+		call, ok := wasi[f.name]
+		if ok && !callable(f.name, t) {
+			return fmt.Errorf("import %s.%s is not supported", f.module, f.name)
+		}
+		if !ok {
+			call = func(m *machine, args []uint64) []uint64 {
+				if len(t.results) == 1 && t.results[0] == typeI32 {
+					return result(errnoNosys)
+				}
+				panic(trap{message: "unsupported system call"})
+			}
+		}
+		f.host = call
+	}
+	return nil
+}
+
+// callable checks the number of parameters, so that a wrong signature cannot read outside of the arguments.
+func callable(name string, t funcType) bool {
+	parameters := map[string]int{
+		"fd_write": 4, "fd_read": 4, "fd_close": 1, "fd_seek": 4, "fd_fdstat_get": 2,
+		"fd_prestat_get": 2, "fd_prestat_dir_name": 3,
+		"args_sizes_get": 2, "args_get": 2, "environ_sizes_get": 2, "environ_get": 2,
+		"clock_res_get": 2, "clock_time_get": 3, "random_get": 2,
+		"sched_yield": 0, "proc_exit": 1, "proc_raise": 1,
+	}
+	if name == "proc_exit" {
+		return len(t.params) == 1 && len(t.results) == 0
+	}
+	return len(t.params) == parameters[name] && len(t.results) == 1 && t.results[0] == typeI32
+}
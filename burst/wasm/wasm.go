@@ -0,0 +1,276 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gitlab.com/eper.io/engine/burst/runtimes"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/mesh"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Wasm is a burst runtime running WebAssembly modules in a pure Go interpreter in the box process.
+// It needs no container engine and no interpreter in the image, and modules start in microseconds.
+// Modules cannot reach anything outside their memory except for standard input and output.
+// Each run is limited by metadata.BurstFuel instructions, the burst memory and cpu time, and the output limit.
+// The same module with the same input returns the same result.
+// The module runs its exported _start function like a WASI command.
+//
+// Send a compiled module as the burst.
+// curl -X PUT http://127.0.0.1:7777/run?apikey=ABC --data-binary @hello.wasm
+// Send a module in a bag. The first line refers to the bag, and the rest of the request is the standard input.
+// curl -X PUT http://127.0.0.1:7777/tmp?apikey=DEF --data-binary @upper.wasm
+// curl -X PUT http://127.0.0.1:7777/run?apikey=ABC -d 'Run the following wasm module.DEF
+// hello world'
+// Bags are referred by their api key only. The node finds the bag in the mesh, and modules are limited by metadata.BurstModule.
+
+const Magic = "\x00asm"
+
+var ErrOutOfFuel = errors.New("wasm burst ran out of fuel")
+
+var ErrNotBag = errors.New("burst refers to something else than a bag api key")
+
+func init() {
+	runtimes.Register("wasm", &runtimes.Runtime{
+		Prefix:     "Run the following wasm code.",
+		Native:     runCode,
+		Mock:       Magic + "\x01\x00\x00\x00",
+		MockResult: "Hello World!\n",
+	})
+	runtimes.Register("wasm module", &runtimes.Runtime{
+		Prefix:     "Run the following wasm module.",
+		Native:     runModule,
+		Mock:       "mock\nHello World!\n",
+		MockResult: "Hello World!\n",
+	})
+}
+
+func runCode(code string, streams sandbox.Streams, limits sandbox.Limits) sandbox.Result {
+	return ExecuteStreams([]byte(code), streams, limits)
+}
+
+// runModule runs a module of a bag. The rest of the code is the standard input followed by the input stream.
+func runModule(code string, streams sandbox.Streams, limits sandbox.Limits) sandbox.Result {
+	reference, stdin, _ := strings.Cut(code, "\n")
+	module, err := loadModule(strings.TrimSpace(reference))
+	if err != nil {
+		return sandbox.Failure(err)
+	}
+	if streams.Stdin != nil {
+		streams.Stdin = io.MultiReader(strings.NewReader(stdin), streams.Stdin)
+	} else {
+		streams.Stdin = strings.NewReader(stdin)
+	}
+	return ExecuteStreams(module, streams, limits)
+}
+
+func loadModule(bag string) ([]byte, error) {
+	url, err := BagUrl(bag)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := mesh.OpenPeerRequest(url, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = reply.Close() }()
+	module, err := io.ReadAll(io.LimitReader(reply, metadata.BurstModule+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(module)) > metadata.BurstModule {
+		return nil, fmt.Errorf("wasm module is larger than %d bytes", metadata.BurstModule)
+	}
+	return module, nil
+}
+
+// BagUrl returns the url of a bag on this node, that forwards it to the node of the bag.
+// Anything else than an api key is refused, so that bursts cannot make the node call other urls.
+func BagUrl(bag string) (string, error) {
+	if bag == "" || len(bag) > 256 {
+		return "", ErrNotBag
+	}
+	for _, c := range bag {
+		if c < 'A' || c > 'Z' {
+			return "", ErrNotBag
+		}
+	}
+	return "http://127.0.0.1" + metadata.Http11Port + "/tmp?apikey=" + bag, nil
+}
+
+// Run runs a module with the input as its standard input, and it returns the standard output.
+// Traps, running out of fuel, time or memory, and non-zero exit codes return an error.
+func Run(code []byte, stdin []byte, limits sandbox.Limits) ([]byte, sandbox.Usage, error) {
+	result := Execute(code, stdin, limits)
+	return result.Stdout, result.Usage, result.Err
+}
+
+// Execute runs a module like Run, and it returns the exit code and the standard error as well.
+// Modules stopped by a trap have the exit code -1 like killed processes.
+func Execute(code []byte, stdin []byte, limits sandbox.Limits) sandbox.Result {
+	return ExecuteStreams(code, sandbox.Streams{Stdin: bytes.NewReader(stdin)}, limits)
+}
+
+// ExecuteStreams runs a module like Execute with its standard input and output connected to the streams.
+func ExecuteStreams(code []byte, streams sandbox.Streams, limits sandbox.Limits) (result sandbox.Result) {
+	started := time.Now()
+	m, err := decode(code)
+	if err != nil {
+		return sandbox.Failure(err)
+	}
+	err = link(m)
+	if err != nil {
+		return sandbox.Failure(err)
+	}
+	vm := newMachine(m, streams, limits)
+	defer func() {
+		result.Stdout = vm.host.stdout.Bytes()
+		result.Stderr = vm.host.stderr.Bytes()
+		result.Duration = time.Now().Sub(started)
+		result.Usage = sandbox.Usage{Cpu: result.Duration}
+		failure := recover()
+		if failure == nil {
+			return
+		}
+		code, err := failed(failure)
+		if code > 0 {
+			result.ExitCode = code
+			result.Err = err
+		} else if err != nil {
+			result.Stop(err)
+		}
+	}()
+	vm.instantiate()
+	start, ok := m.exports["_start"]
+	if !ok || start.kind != 0 {
+		panic(errors.New("wasm module does not export a _start function"))
+	}
+	vm.call(start.index)
+	return
+}
+
+// failed turns the panic of a stopped module into an exit code and an error.
+func failed(failure interface{}) (int, error) {
+	switch f := failure.(type) {
+	case exit:
+		if f.code == 0 {
+			return 0, nil
+		}
+		return int(f.code), fmt.Errorf("wasm burst exited with %d", f.code)
+	case trap:
+		if f.message == "out of fuel" {
+			return -1, ErrOutOfFuel
+		}
+		if f.message == "out of time" {
+			return -1, sandbox.ErrTimeout
+		}
+		return -1, fmt.Errorf("wasm burst trapped with %s", f.message)
+	case runtime.Error:
+		// Modules are not validated ahead of time, so invalid indexes and stacks stop here.
+		return -1, fmt.Errorf("invalid wasm module %s", f.Error())
+	case error:
+		return -1, f
+	}
+	panic(failure)
+}
+
+func newMachine(m *module, streams sandbox.Streams, limits sandbox.Limits) *machine {
+	if streams.Stdin == nil {
+		streams.Stdin = bytes.NewReader([]byte{})
+	}
+	timeout := limits.Timeout
+	if timeout <= 0 || limits.CpuTime > 0 && limits.CpuTime < timeout {
+		timeout = limits.CpuTime
+	}
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	pages := uint32(maxPages)
+	if limits.Memory > 0 && limits.Memory/pageSize < int64(pages) {
+		pages = uint32(limits.Memory / pageSize)
+	}
+	if m.memoryMax < pages {
+		pages = m.memoryMax
+	}
+	output := limits.Output
+	if output <= 0 {
+		output = math.MaxInt64
+	}
+	fuel := metadata.BurstFuel
+	if fuel <= 0 {
+		fuel = math.MaxInt64
+	}
+	return &machine{
+		module:   m,
+		maxPages: pages,
+		dropped:  map[string]bool{},
+		stack:    make([]uint64, 0, 1024),
+		fuel:     fuel,
+		deadline: time.Now().Add(timeout),
+		host: &host{
+			stdin:  streams.Stdin,
+			stdout: &limitedBuffer{target: streams.Stdout, left: output},
+			stderr: &limitedBuffer{left: output},
+			random: rand.New(rand.NewSource(1)),
+			fuel:   fuel,
+		},
+	}
+}
+
+// instantiate sets up the memory, globals and tables of the module, and it runs its start function.
+func (m *machine) instantiate() {
+	if m.module.memory {
+		if m.module.memoryMin > m.maxPages {
+			panic(errors.New("wasm module needs more memory than the burst limit"))
+		}
+		m.memory = make([]byte, int(m.module.memoryMin)*pageSize)
+	}
+	for _, g := range m.module.globals {
+		m.globals = append(m.globals, m.evaluate(g.init))
+	}
+	for _, t := range m.module.tables {
+		if t.min > maxTableSize {
+			panic(errors.New("wasm table is too large"))
+		}
+		m.tables = append(m.tables, make([]uint64, t.min))
+	}
+	for i, e := range m.module.elements {
+		if e.mode == elementActive {
+			offset := uint32(m.evaluate(e.offset))
+			refs := m.elementRefs(uint32(i))
+			t := m.table(e.table)
+			if uint64(offset)+uint64(len(refs)) > uint64(len(t)) {
+				fail("out of bounds table access")
+			}
+			copy(t[offset:], refs)
+		}
+		if e.mode != elementPassive {
+			m.dropped[fmt.Sprintf("elem %d", i)] = true
+		}
+	}
+	for i, d := range m.module.data {
+		if d.active {
+			offset := uint32(m.evaluate(d.offset))
+			m.checkMemory(offset, uint32(len(d.bytes)))
+			copy(m.memory[offset:], d.bytes)
+			m.dropped[fmt.Sprintf("data %d", i)] = true
+		}
+	}
+	if m.module.start >= 0 {
+		m.call(uint32(m.module.start))
+	}
+}
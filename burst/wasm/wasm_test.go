@@ -0,0 +1,218 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"gitlab.com/eper.io/engine/burst/sandbox"
+	"gitlab.com/eper.io/engine/metadata"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+var voidType = []byte{0x60, 0, 0}
+var fdWriteType = []byte{0x60, 4, typeI32, typeI32, typeI32, typeI32, 1, typeI32}
+
+// startModule returns a module running the code as its _start function with a page of memory.
+func startModule(code ...byte) []byte {
+	return testModule(testSection(1, testVector(voidType)),
+		testSection(3, testVector([]byte{0})),
+		testSection(5, testVector([]byte{0, 1})),
+		testSection(7, testVector(append(testString("_start"), 0, 0))),
+		testSection(10, testVector(testString(string(append([]byte{0}, code...))))))
+}
+
+func testModule(sections ...[]byte) []byte {
+	return append([]byte(Magic+"\x01\x00\x00\x00"), bytes.Join(sections, nil)...)
+}
+
+func testSection(id byte, content []byte) []byte {
+	return append(append([]byte{id}, testUleb(len(content))...), content...)
+}
+
+func testVector(items ...[]byte) []byte {
+	return append(testUleb(len(items)), bytes.Join(items, nil)...)
+}
+
+func testString(s string) []byte {
+	return append(testUleb(len(s)), s...)
+}
+
+func testUleb(n int) []byte {
+	ret := make([]byte, 0)
+	for n >= 0x80 {
+		ret = append(ret, byte(n&0x7F|0x80))
+		n = n >> 7
+	}
+	return append(ret, byte(n))
+}
+
+func testLimits() sandbox.Limits {
+	return sandbox.Limits{Memory: 16 * pageSize, Output: 4096, Timeout: time.Second}
+}
+
+func TestDecode(t *testing.T) {
+	valid := startModule(0x01, 0x0B)
+	if _, err := decode(valid); err != nil {
+		t.Fatal(err)
+	}
+	// Truncated modules fail, unless they end at a section boundary.
+	boundaries := map[int]bool{8: true}
+	r := &reader{b: valid, pos: 8}
+	for r.pos < len(r.b) {
+		r.byte()
+		r.bytes(r.u32())
+		boundaries[r.pos] = true
+	}
+	for i := 0; i < len(valid); i++ {
+		_, err := decode(valid[:i])
+		if err == nil && !boundaries[i] {
+			t.Error("truncated module decoded at", i)
+		}
+	}
+
+	malformed := map[string][]byte{
+		"magic":           append([]byte("\x00wsm"), valid[4:]...),
+		"version":         append([]byte(Magic+"\x02\x00\x00\x00"), valid[8:]...),
+		"section length":  testModule([]byte{1, 0x7F}, testVector(voidType)),
+		"long leb":        testModule([]byte{1, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}),
+		"section id":      testModule(testSection(13, nil)),
+		"function type":   testModule(testSection(1, testVector([]byte{0x61, 0, 0}))),
+		"value type":      testModule(testSection(1, testVector([]byte{0x60, 1, 0x7B, 0}))),
+		"type index":      testModule(testSection(1, testVector(voidType)), testSection(3, testVector([]byte{1})), testSection(10, testVector(testString("\x00\x0B")))),
+		"missing code":    testModule(testSection(1, testVector(voidType)), testSection(3, testVector([]byte{0}))),
+		"code count":      testModule(testSection(1, testVector(voidType)), testSection(10, testVector(testString("\x00\x0B")))),
+		"unclosed block":  startModule(0x02, 0x40, 0x0B),
+		"else":            startModule(0x05, 0x0B),
+		"instruction":     startModule(0xFD, 0x0B),
+		"memories":        testModule(testSection(5, testVector([]byte{0, 1}, []byte{0, 1}))),
+		"shared memory":   testModule(testSection(5, testVector([]byte{3, 1, 2}))),
+		"too many locals": testModule(testSection(1, testVector(voidType)), testSection(3, testVector([]byte{0})), testSection(10, testVector(testString("\x01\xFF\xFF\x03\x7F\x0B")))),
+		"import kind":     testModule(testSection(2, testVector(append(append(testString("env"), testString("memory")...), 2, 0, 1)))),
+	}
+	for name, code := range malformed {
+		if _, err := decode(code); err == nil {
+			t.Error("malformed module decoded", name)
+		}
+	}
+}
+
+func TestTraps(t *testing.T) {
+	traps := map[string][]byte{
+		"load past the memory":   startModule(0x41, 0xFD, 0xFF, 0x03, 0x28, 2, 0, 0x1A, 0x0B),
+		"offset past the memory": startModule(0x41, 0x7F, 0x28, 2, 4, 0x1A, 0x0B),
+		"store past the memory":  startModule(0x41, 0x80, 0x80, 0x04, 0x41, 1, 0x3A, 0, 0, 0x0B),
+		"unreachable":            startModule(0x00, 0x0B),
+		"division by zero":       startModule(0x41, 1, 0x41, 0, 0x6D, 0x1A, 0x0B),
+		"call stack":             startModule(0x10, 0, 0x0B),
+		"data past the memory": testModule(testSection(1, testVector(voidType)),
+			testSection(3, testVector([]byte{0})),
+			testSection(5, testVector([]byte{0, 1})),
+			testSection(7, testVector(append(testString("_start"), 0, 0))),
+			testSection(10, testVector(testString("\x00\x0B"))),
+			testSection(11, testVector(append([]byte{0, 0x41, 0xFE, 0xFF, 0x03, 0x0B}, testString("four")...)))),
+		"iovec past the memory": testModule(testSection(1, testVector(fdWriteType, voidType)),
+			testSection(2, testVector(append(append(testString("wasi_snapshot_preview1"), testString("fd_write")...), 0, 0))),
+			testSection(3, testVector([]byte{1})),
+			testSection(5, testVector([]byte{0, 1})),
+			testSection(7, testVector(append(testString("_start"), 0, 1))),
+			testSection(10, testVector(testString(string([]byte{0, 0x41, 1, 0x41, 0xFC, 0xFF, 0x03, 0x41, 1, 0x41, 0, 0x10, 0, 0x1A, 0x0B}))))),
+	}
+	for name, code := range traps {
+		result := Execute(code, nil, testLimits())
+		if result.Err == nil || result.ExitCode != -1 || !strings.Contains(result.Err.Error(), "wasm burst trapped") {
+			t.Error(name, result.Err)
+		}
+	}
+	result := Execute(traps["load past the memory"], nil, testLimits())
+	if !strings.HasSuffix(string(result.Stderr), "out of bounds memory access\n") {
+		t.Error(string(result.Stderr))
+	}
+
+	limits := testLimits()
+	limits.Memory = pageSize / 2
+	result = Execute(startModule(0x0B), nil, limits)
+	if result.Err == nil {
+		t.Error("memory was not limited")
+	}
+}
+
+func TestStackUnderflow(t *testing.T) {
+	for _, code := range [][]byte{
+		startModule(0x6A, 0x0B),
+		startModule(0x1A, 0x0B),
+		startModule(0x41, 1, 0x1B, 0x1A, 0x0B),
+		startModule(0x21, 0, 0x0B),
+		startModule(0x28, 2, 0, 0x0B),
+	} {
+		result := Execute(code, nil, testLimits())
+		if result.Err == nil || result.ExitCode != -1 {
+			t.Error("stack underflow ran", code, result.Err)
+		}
+	}
+}
+
+func TestFuel(t *testing.T) {
+	fuel := metadata.BurstFuel
+	defer func() { metadata.BurstFuel = fuel }()
+
+	// nop, nop and end burn three units.
+	straight := startModule(0x01, 0x01, 0x0B)
+	metadata.BurstFuel = 3
+	if result := Execute(straight, nil, testLimits()); result.Err != nil {
+		t.Error(result.Err)
+	}
+	metadata.BurstFuel = 2
+	if result := Execute(straight, nil, testLimits()); result.Err != ErrOutOfFuel {
+		t.Error("fuel was not counted", result.Err)
+	}
+
+	metadata.BurstFuel = 100000
+	loop := startModule(0x03, 0x40, 0x0C, 0, 0x0B, 0x0B)
+	result := Execute(loop, nil, testLimits())
+	if result.Err != ErrOutOfFuel || result.ExitCode != -1 || result.TimedOut {
+		t.Error("fuel was not limited", result.Err)
+	}
+
+	metadata.BurstFuel = 0
+	limits := testLimits()
+	limits.Timeout = 50 * time.Millisecond
+	result = Execute(loop, nil, limits)
+	if !errors.Is(result.Err, sandbox.ErrTimeout) || !result.TimedOut {
+		t.Error("time was not limited", result.Err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(startModule(0x01, 0x0B))
+	f.Add(startModule(0x03, 0x40, 0x0C, 0, 0x0B, 0x0B))
+	f.Add(startModule(0x41, 0xFD, 0xFF, 0x03, 0x28, 2, 0, 0x1A, 0x0B))
+	f.Add(testModule(testSection(1, testVector(fdWriteType, voidType)),
+		testSection(2, testVector(append(append(testString("wasi_snapshot_preview1"), testString("fd_write")...), 0, 0))),
+		testSection(3, testVector([]byte{1})),
+		testSection(5, testVector([]byte{0, 1})),
+		testSection(7, testVector(append(testString("_start"), 0, 1))),
+		testSection(10, testVector(testString(string([]byte{0, 0x41, 1, 0x41, 0, 0x41, 1, 0x41, 20, 0x10, 0, 0x1A, 0x0B})))),
+		testSection(11, testVector(append([]byte{0, 0x41, 0, 0x0B}, testString("\x08\x00\x00\x00\x05\x00\x00\x00Hello")...)))))
+	fuel := metadata.BurstFuel
+	metadata.BurstFuel = 10000
+	defer func() { metadata.BurstFuel = fuel }()
+	f.Fuzz(func(t *testing.T, code []byte) {
+		m, err := decode(code)
+		if err != nil {
+			if m != nil {
+				t.Error("malformed module returned")
+			}
+			return
+		}
+		// Decoded modules may still trap or be invalid, but they stop with an error instead of a crash.
+		Execute(code, []byte("fuzz"), testLimits())
+	})
+}
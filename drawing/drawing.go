@@ -87,7 +87,7 @@ func DeclareForm(session *Session, pngFile string) {
 		fmt.Println(fmt.Sprintf("SignalClicked needs to be implemented."))
 	}
 	session.SignalUploaded = func(session *Session, upload Upload) {
-		fmt.Println(fmt.Sprintf("Uploaded %d bytes", len(upload.Body)))
+		fmt.Println(fmt.Sprintf("Uploaded %d bytes", upload.Length))
 		fmt.Println(fmt.Sprintf("SignalUploaded needs to be implemented."))
 	}
 	session.SignalClosed = func(session *Session) {
@@ -150,14 +150,19 @@ func PutText(session *Session, i int, t Content) int {
 }
 
 func SetImage(session *Session, i int, pngFile string, t Content) int {
+	t.BackgroundFile = pngFile
+	ro := NoErrorImage(png.Decode(NoErrorFile(os.Open(t.BackgroundFile))))
+	return PutImage(session, i, ro, t)
+}
+
+// PutImage draws an image generated on the fly into a box like SetImage does with files.
+func PutImage(session *Session, i int, img image.Image, t Content) int {
 	if i == -1 {
 		i = len(session.Text)
 	}
-	t.BackgroundFile = pngFile
-	ro := NoErrorImage(png.Decode(NoErrorFile(os.Open(t.BackgroundFile))))
 	rw := image.NewRGBA64(session.Form.Boxes[i])
 	t.Background = ImageSlice{Rgb: rw, Rect: rw.Bounds()}
-	DrawImage(t.Background, ro)
+	DrawImage(t.Background, img)
 	session.Text[i] = t
 	return i
 }
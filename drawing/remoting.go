@@ -9,6 +9,7 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
@@ -54,7 +55,10 @@ type Session struct {
 
 type Upload struct {
 	Type string
-	Body []byte
+	// Body streams the uploaded file. It is valid until SignalUploaded returns.
+	Body io.Reader
+	// Length is the size of the upload, or -1, if it is unknown.
+	Length int64
 }
 
 func ResetSession(w http.ResponseWriter, r *http.Request) error {
@@ -1,7 +1,6 @@
 package drawing
 
 import (
-	"io"
 	"net/http"
 )
 
@@ -23,7 +22,7 @@ func SetupUploads() {
 			return
 		}
 		session := GetSession(w, r)
-		dat, _ := io.ReadAll(r.Body)
-		session.SignalUploaded(session, Upload{Body: dat, Type: r.Header.Get("Application-Binary-Type")})
+		// Uploads are streamed, large files do not need to fit into memory.
+		session.SignalUploaded(session, Upload{Body: r.Body, Length: r.ContentLength, Type: r.Header.Get("Application-Binary-Type")})
 	})
 }
@@ -1,6 +1,8 @@
 package englang
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -51,3 +53,19 @@ func TestEnglangEvaluate(t *testing.T) {
 		t.Error("evaluation error" + Evaluate("10.1 multiplied by USD 12"))
 	}
 }
+
+func TestIndexedEntry(t *testing.T) {
+	backup := bytes.Buffer{}
+	w := bufio.NewWriter(&backup)
+	WriteIndexedEntry(w, "ABC", "bag", bytes.NewBufferString("first"))
+	WriteIndexedEntry(w, "DEF", "share", bytes.NewBufferString("second"))
+	_ = w.Flush()
+	backup.WriteString("Indexed GHI entity bag of bytes 6 follows.\nlegacy")
+	r := bufio.NewReader(&backup)
+	for _, expected := range [][]string{{"bag", "ABC", "first"}, {"share", "DEF", "second"}, {"bag", "GHI", "legacy"}, {"", "", ""}} {
+		entity, key, content := ReadIndexedEntry(r)
+		if entity != expected[0] || key != expected[1] || content != expected[2] {
+			t.Error(entity, key, content)
+		}
+	}
+}
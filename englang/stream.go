@@ -14,20 +14,40 @@ import (
 // You should have received a copy of the CC0 Public Domain Dedication along with this document.
 // If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
 
-func ReadIndexedEntry(r bufio.Reader) (string, string, string) {
+// Backups are lists of indexed entries like Indexed bag entity <key> of bytes 5 follows.
+// The reader is shared by all modules restoring from the same backup, so that each continues where the previous stopped.
+// Earlier writers swapped the key and the entity like Indexed <key> entity bag of bytes 5 follows.
+// Entities are short lowercase words, and keys are not, so such entries are read back swapped.
+
+func ReadIndexedEntry(r *bufio.Reader) (string, string, string) {
 	line, _ := r.ReadBytes('\n')
 	var entity, key, lengths string
 	if nil == Scanf1(string(line), "Indexed %s entity %s of bytes %s follows.\n", &entity, &key, &lengths) {
 		length := Decimal(lengths)
 		content := make([]byte, length)
-		n, _ := io.ReadFull(&r, content)
+		n, _ := io.ReadFull(r, content)
+		if isEntityName(key) && !isEntityName(entity) {
+			entity, key = key, entity
+		}
 		return entity, key, string(content[0:n])
 	} else {
 		return "", "", ""
 	}
 }
 
-func WriteIndexedEntry(w *bufio.Writer, entity string, k string, buf *bytes.Buffer) {
+func isEntityName(s string) bool {
+	if s == "" || len(s) > 16 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func WriteIndexedEntry(w *bufio.Writer, k string, entity string, buf *bytes.Buffer) {
 	drawing.NoErrorWrite(w.WriteString(Printf("Indexed %s entity %s of bytes %s follows.\n", entity, k, DecimalString(int64(buf.Len())))))
 	_, _ = w.Write(buf.Bytes())
 }
@@ -1,7 +1,9 @@
 package mesh
 
 import (
+	"fmt"
 	"gitlab.com/eper.io/engine/englang"
+	"strings"
 	"time"
 )
 
@@ -61,3 +63,60 @@ func CheckExpiry(key string) bool {
 	_, ok := index[key]
 	return ok
 }
+
+// ExtendExpiry adds a period to the current expiry of a key, or to now, if it is not set.
+func ExtendExpiry(key string, period time.Duration) time.Time {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	n := time.Now()
+	var current string
+	if nil == englang.Scanf(expiry[key], "Validated until %s.", &current) {
+		t, err := time.Parse("Jan 2, 2006", current)
+		if err == nil && t.After(n) {
+			n = t
+		}
+	}
+	n = n.Add(period)
+	expiry[key] = englang.Printf("Validated until %s.", n.Format("Jan 2, 2006"))
+	return n
+}
+
+func GetExpiry(key string) (time.Time, error) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	var current string
+	if nil != englang.Scanf(expiry[key], "Validated until %s.", &current) {
+		return time.Time{}, fmt.Errorf("not found")
+	}
+	return time.Parse("Jan 2, 2006", current)
+}
+
+// ExpiryRecordLine is the expiry of a key to be kept in the record of the item, so that it is backed up with it.
+func ExpiryRecordLine(key string) string {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	return expiry[key]
+}
+
+// RestoreExpiry registers a restored item on this node with the expiry in its record.
+// Records without an expiry get the period. Expired items are not registered, so that they are cleaned up.
+func RestoreExpiry(key string, record string, period time.Duration) bool {
+	until := time.Now().Add(period)
+	for _, line := range strings.Split(record, "\n") {
+		var current string
+		if nil == englang.Scanf1(line, "Validated until %s.", &current) {
+			t, err := time.Parse("Jan 2, 2006", current)
+			if err == nil {
+				until = t
+			}
+		}
+	}
+	if time.Now().After(until) {
+		return false
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	index[key] = WhoAmI
+	expiry[key] = englang.Printf("Validated until %s.", until.Format("Jan 2, 2006"))
+	return true
+}
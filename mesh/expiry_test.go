@@ -0,0 +1,35 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+func TestRestoreExpiry(t *testing.T) {
+	record := SetRecordLine("Burst session.\nNotify ops@example.com 48 hours before expiry.\n", NotificationPrefix, "")
+	if record != "Burst session." {
+		t.Error(record)
+	}
+	SetExpiry("TESTRESTOREEXPIRY", 48*time.Hour)
+	record = SetRecordLine(record, "Validated until ", ExpiryRecordLine("TESTRESTOREEXPIRY"))
+	expires, _ := GetExpiry("TESTRESTOREEXPIRY")
+	DeleteIndex("TESTRESTOREEXPIRY")
+	if !RestoreExpiry("TESTRESTOREEXPIRY", record, time.Hour) || !CheckExpiry("TESTRESTOREEXPIRY") {
+		t.Error("not restored")
+	}
+	defer DeleteIndex("TESTRESTOREEXPIRY")
+	restored, _ := GetExpiry("TESTRESTOREEXPIRY")
+	if !restored.Equal(expires) {
+		t.Error(restored)
+	}
+	if RestoreExpiry("TESTRESTOREEXPIRED", "Validated until Jan 2, 2006.", time.Hour) || CheckExpiry("TESTRESTOREEXPIRED") {
+		t.Error("expired item was restored")
+	}
+}
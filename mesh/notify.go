@@ -0,0 +1,241 @@
+package mesh
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/drawing"
+	"gitlab.com/eper.io/engine/englang"
+	"gitlab.com/eper.io/engine/management"
+	"gitlab.com/eper.io/engine/metadata"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Temporary items like bags and bursts vanish after expiry.
+// Their owners can ask for an Englang message before expiry and at deletion.
+// The target is a webhook url getting a PUT, or an email address sent through metadata.SmtpRelay.
+// The request is a line of the item record, so that it is backed up with the item.
+// Webhooks reach public addresses only. Loopback, private, link local and mesh node addresses are refused,
+// when the target is set and again, when the resolved address is dialed, so that owners cannot reach internal services.
+
+const ExpiryWarningSent = "Expiry warning was sent."
+
+const NotificationPrefix = "Notify "
+
+// SetRecordLine replaces the lines of a record starting with the prefix. An empty line removes them.
+func SetRecordLine(record string, prefix string, line string) string {
+	lines := make([]string, 0)
+	for _, current := range strings.Split(strings.TrimRight(record, "\n"), "\n") {
+		if !strings.HasPrefix(current, prefix) {
+			lines = append(lines, current)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ServeNotification sets, gets and deletes the notification of an authorized item.
+// The warning period is at most the validity of the item, and setLine updates the record of the item.
+func ServeNotification(w http.ResponseWriter, r *http.Request, record string, valid time.Duration, setLine func(prefix string, line string)) {
+	if r.Method == "PUT" {
+		target := strings.TrimSpace(drawing.NoErrorString(io.ReadAll(io.LimitReader(r.Body, 1024))))
+		if !IsValidNotificationTarget(target) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lead := metadata.ExpiryWarning
+		hours := englang.Decimal(r.URL.Query().Get("hours"))
+		if hours > 0 && time.Duration(hours)*time.Hour <= valid {
+			lead = time.Duration(hours) * time.Hour
+		}
+		setLine(NotificationPrefix, NotificationRecordLine(target, lead))
+		setLine(ExpiryWarningSent, "")
+		return
+	}
+	if r.Method == "GET" {
+		target, lead, _ := GetNotification(record)
+		if target != "" {
+			management.QuantumGradeAuthorization()
+			_, _ = w.Write([]byte(NotificationRecordLine(target, lead)))
+		}
+		return
+	}
+	if r.Method == "DELETE" {
+		setLine(NotificationPrefix, "")
+		setLine(ExpiryWarningSent, "")
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// NotifyOwner sends a message in the background.
+func NotifyOwner(target string, message string) {
+	go func() {
+		err := Notify(target, message)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+func NotificationRecordLine(target string, lead time.Duration) string {
+	return englang.Printf("Notify %s %s hours before expiry.", target, englang.DecimalString(int64(lead/time.Hour)))
+}
+
+// AllowLocalNotifications lets webhooks reach local and private addresses. Tests use it.
+var AllowLocalNotifications = false
+
+func IsValidNotificationTarget(target string) bool {
+	if strings.ContainsAny(target, " \r\n") {
+		return false
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Hostname() == "" {
+			return false
+		}
+		ip := net.ParseIP(u.Hostname())
+		if ip != nil {
+			return isPublicAddress(ip)
+		}
+		for _, host := range meshHosts() {
+			if !AllowLocalNotifications && strings.EqualFold(host, u.Hostname()) {
+				return false
+			}
+		}
+		return true
+	}
+	return strings.Contains(target, "@")
+}
+
+// isPublicAddress tells, whether a webhook may be sent to the address.
+func isPublicAddress(ip net.IP) bool {
+	if AllowLocalNotifications {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	_, shared, _ := net.ParseCIDR("100.64.0.0/10")
+	if shared.Contains(ip) {
+		return false
+	}
+	for _, host := range meshHosts() {
+		if ip.Equal(net.ParseIP(host)) {
+			return false
+		}
+	}
+	return true
+}
+
+// meshHosts returns the host names and addresses of the mesh nodes including this one.
+func meshHosts() []string {
+	ret := []string{"localhost"}
+	nodes := []string{WhoAmI}
+	for node := range Nodes {
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		u, err := url.Parse(node)
+		if err == nil && u.Hostname() != "" {
+			ret = append(ret, u.Hostname())
+		}
+	}
+	return ret
+}
+
+// notificationClient checks the address after the name is resolved, so that names pointing to internal addresses are refused.
+var notificationClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !isPublicAddress(ip) {
+					return fmt.Errorf("notification target %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// GetNotification returns the target and the warning period set in a record.
+func GetNotification(record string) (string, time.Duration, bool) {
+	warned := false
+	target := ""
+	lead := time.Duration(0)
+	for _, line := range strings.Split(record, "\n") {
+		var t, hours string
+		if nil == englang.Scanf1(line, "Notify %s %s hours before expiry.", &t, &hours) {
+			target = t
+			lead = time.Duration(englang.Decimal(hours)) * time.Hour
+		}
+		if line == ExpiryWarningSent {
+			warned = true
+		}
+	}
+	return target, lead, warned
+}
+
+// ExpiryWarningDue tells, if the owner of a key should be warned now.
+func ExpiryWarningDue(key string, record string) (string, time.Time, bool) {
+	target, lead, warned := GetNotification(record)
+	if target == "" || warned {
+		return "", time.Time{}, false
+	}
+	expires, err := GetExpiry(key)
+	if err != nil || time.Now().Add(lead).Before(expires) {
+		return "", time.Time{}, false
+	}
+	return target, expires, true
+}
+
+func Notify(target string, message string) error {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		if !IsValidNotificationTarget(target) {
+			return fmt.Errorf("invalid target")
+		}
+		req, err := http.NewRequest("PUT", target, strings.NewReader(message))
+		if err != nil {
+			return err
+		}
+		resp, err := notificationClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("notification target replied %s", resp.Status)
+		}
+		return nil
+	}
+	if strings.Contains(target, "@") {
+		if metadata.SmtpRelay == "" {
+			return fmt.Errorf("no smtp relay")
+		}
+		mail := fmt.Sprintf("To: %s\r\nFrom: %s\r\nSubject: %s\r\n\r\n%s\r\n", target, metadata.CompanyEmail, metadata.SiteName, message)
+		return smtp.SendMail(metadata.SmtpRelay, nil, metadata.CompanyEmail, []string{target}, []byte(mail))
+	}
+	return fmt.Errorf("unknown target")
+}
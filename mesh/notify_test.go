@@ -0,0 +1,50 @@
+package mesh
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+func TestNotificationTarget(t *testing.T) {
+	whoAmI := WhoAmI
+	WhoAmI = "http://203.0.113.7:7777"
+	defer func() { WhoAmI = whoAmI }()
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://10.55.0.1/hook",
+		"https://192.168.1.1/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]/hook", "http://0.0.0.0/hook",
+		"http://203.0.113.7:7777/bag", "http:///hook", "http://example.com/a hook"} {
+		if IsValidNotificationTarget(target) {
+			t.Error(target)
+		}
+	}
+	for _, target := range []string{"https://198.51.100.1/hook", "https://example.com/hook", "ops@example.com"} {
+		if !IsValidNotificationTarget(target) {
+			t.Error(target)
+		}
+	}
+	if Notify("http://127.0.0.1:1/hook", "Expired.") == nil {
+		t.Error("local target notified")
+	}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("resolved local target notified")
+	}))
+	defer hook.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(hook.URL, "http://"))
+	if Notify("http://localhost.:"+port+"/hook", "Expired.") == nil {
+		t.Error("local target notified")
+	}
+	AllowLocalNotifications = true
+	defer func() { AllowLocalNotifications = false }()
+	if !IsValidNotificationTarget("http://127.0.0.1:8080/hook") {
+		t.Error("local target refused in tests")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"gitlab.com/eper.io/engine/englang"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // This document is Licensed under Creative Commons CC0.
@@ -15,26 +16,55 @@ import (
 // You should have received a copy of the CC0 Public Domain Dedication along with this document.
 // If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
 
+// Headers are forwarded both ways except for the hop-by-hop headers of RFC 7230 section 6.1.
+// Ranged reads and partial writes rely on Range, Content-Range and their replies.
+// The status code is written before the body, otherwise it is ignored by net/http.
+
 func RedirectToPeerServer(w http.ResponseWriter, r *http.Request) error {
-	apiKey := r.URL.Query().Get("apikey")
-	if apiKey == "" {
+	return RedirectToPeerServerByKey(w, r, r.URL.Query().Get("apikey"))
+}
+
+// RedirectToPeerServerByKey forwards the request to the node of an index key, like the fingerprint of the apikey.
+func RedirectToPeerServerByKey(w http.ResponseWriter, r *http.Request, key string) error {
+	if key == "" {
 		return fmt.Errorf("not found")
 	}
-	server := GetIndex(apiKey)
+	server := GetIndex(key)
 	if server == "" || server == WhoAmI {
 		return fmt.Errorf("not found")
 	}
 	if englang.Synonym(Nodes[server], "This node got an eviction notice.") {
 		return fmt.Errorf("not found")
 	}
+	forwardToServer(w, r, server)
+	return nil
+}
+
+func forwardToServer(w http.ResponseWriter, r *http.Request, server string) {
 	modified := fmt.Sprintf("%s%s", server, r.URL.RequestURI())
-	resp, status, _ := httpProxyRequest(modified, r.Method, r.Body)
-	_, _ = io.Copy(w, resp)
+	resp, header, status, _ := httpProxyRequest(modified, r.Method, r.Header, r.Body)
+	copyHeader(w.Header(), header)
 	w.WriteHeader(status)
-	return nil
+	if resp != nil {
+		_, _ = io.Copy(w, resp)
+		_ = resp.Close()
+	}
 }
 
-func httpProxyRequest(url string, method string, bodyIn io.Reader) (io.ReadCloser, int, error) {
+// OpenPeerRequest streams the reply of a peer node. Replies other than 200 OK are errors.
+func OpenPeerRequest(url string, method string, bodyIn io.Reader) (io.ReadCloser, error) {
+	resp, _, status, err := httpProxyRequest(url, method, nil, bodyIn)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		_ = resp.Close()
+		return nil, fmt.Errorf("peer replied %d", status)
+	}
+	return resp, nil
+}
+
+func httpProxyRequest(url string, method string, headerIn http.Header, bodyIn io.Reader) (io.ReadCloser, http.Header, int, error) {
 	// Poke around within the mesh network
 	if method == "" {
 		method = "GET"
@@ -44,13 +74,34 @@ func httpProxyRequest(url string, method string, bodyIn io.Reader) (io.ReadClose
 	}
 	req, err := http.NewRequest(method, url, bodyIn)
 	if err != nil {
-		return nil, http.StatusInternalServerError, err
+		return nil, nil, http.StatusInternalServerError, err
 	}
+	copyHeader(req.Header, headerIn)
 	// Use a client not associated with the Server.
 	var c http.Client
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, http.StatusInternalServerError, err
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	return resp.Body, resp.Header, resp.StatusCode, nil
+}
+
+var hopByHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// copyHeader copies the end-to-end headers. Headers named by Connection are hop-by-hop as well.
+func copyHeader(dst http.Header, src http.Header) {
+	skip := map[string]bool{}
+	for _, k := range hopByHopHeaders {
+		skip[k] = true
+	}
+	for _, v := range src.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+	for k, v := range src {
+		if !skip[http.CanonicalHeaderKey(k)] {
+			dst[k] = v
+		}
 	}
-	return resp.Body, resp.StatusCode, nil
 }
@@ -0,0 +1,28 @@
+package mesh
+
+import (
+	"net/http"
+	"testing"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+func TestCopyHeader(t *testing.T) {
+	src := http.Header{}
+	src.Set("Connection", "keep-alive, X-Hop")
+	src.Set("Keep-Alive", "timeout=5")
+	src.Set("Transfer-Encoding", "chunked")
+	src.Set("Upgrade", "websocket")
+	src.Set("X-Hop", "1")
+	src.Set("Content-Range", "bytes 0-9/100")
+	dst := http.Header{}
+	copyHeader(dst, src)
+	if len(dst) != 1 || dst.Get("Content-Range") != "bytes 0-9/100" {
+		t.Error(dst)
+	}
+}
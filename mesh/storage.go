@@ -0,0 +1,83 @@
+package mesh
+
+import (
+	"fmt"
+	"gitlab.com/eper.io/engine/englang"
+	"net/http"
+	"sort"
+)
+
+// This document is Licensed under Creative Commons CC0.
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this document to the public domain worldwide.
+// This document is distributed without any warranty.
+// You should have received a copy of the CC0 Public Domain Dedication along with this document.
+// If not, see https://creativecommons.org/publicdomain/zero/1.0/legalcode.
+
+// Nodes report their free bag storage through the index ring.
+// New bags are registered on a node that has space.
+// The report is an index entry like any other, so that it spreads without extra calls.
+
+func nodeStorageKey(node string) string {
+	return englang.Printf("Storage of node %s", node)
+}
+
+func ReportStorage(free int64) {
+	if WhoAmI == "" {
+		return
+	}
+	SetIndex(nodeStorageKey(WhoAmI), englang.Printf("Node has %s bytes free.", englang.DecimalString(free)))
+}
+
+func GetStorage(node string) int64 {
+	var free string
+	if nil != englang.Scanf1(GetIndex(nodeStorageKey(node)), "Node has %s bytes free.", &free) {
+		return -1
+	}
+	return englang.Decimal(free)
+}
+
+func FindNodeWithStorage(needed int64) string {
+	nodes := make([]string, 0)
+	for node, status := range Nodes {
+		if node != WhoAmI && !englang.Synonym(status, "This node got an eviction notice.") && GetStorage(node) > needed {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return ""
+	}
+	sort.Slice(nodes, func(i, j int) bool { return GetStorage(nodes[i]) > GetStorage(nodes[j]) })
+	return nodes[0]
+}
+
+// FindNodesWithStorage places count items on distinct nodes with space including this one.
+// Nodes are never reused, so it returns fewer nodes, if there are not enough of them.
+func FindNodesWithStorage(needed int64, count int) []string {
+	nodes := make([]string, 0)
+	for node, status := range Nodes {
+		if !englang.Synonym(status, "This node got an eviction notice.") && GetStorage(node) > needed {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return GetStorage(nodes[i]) > GetStorage(nodes[j]) })
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// ForwardToNodeWithStorage sends a request creating a bag to a node with free space.
+// Forwarded requests are not forwarded again to avoid loops on stale reports.
+func ForwardToNodeWithStorage(w http.ResponseWriter, r *http.Request, needed int64) error {
+	if r.Header.Get("Mesh-Forwarded") != "" {
+		return fmt.Errorf("not found")
+	}
+	server := FindNodeWithStorage(needed)
+	if server == "" {
+		return fmt.Errorf("not found")
+	}
+	r.Header.Set("Mesh-Forwarded", WhoAmI)
+	forwardToServer(w, r, server)
+	return nil
+}
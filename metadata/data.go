@@ -52,6 +52,66 @@ var StatefulBackupUrl = "http://127.0.0.1" + Http11Port
 // DataRoot will normally be somewhere in /var/lib in the container to get backed up
 var DataRoot = ""
 
+// StorageRoot is the directory of bag files and burst scratch files.
+// Mount a dedicated volume here, if /tmp is a tmpfs on the node.
+// The STORAGEROOT environment variable overrides it.
+var StorageRoot = "/tmp"
+
+// StorageQuota caps the bytes of all bags on a node. Zero means the free disk space only.
+var StorageQuota = int64(0)
+
+// StorageReserve is the free space in bytes, below which a node does not register new bags.
+var StorageReserve = int64(64 * 1024 * 1024)
+
+// BagQuota is the size in bytes of a bag bought with a single voucher.
+// Larger bags are sold as tiers of several vouchers.
+var BagQuota = int64(1024 * 1024 * 1024)
+
+// BagVersions is the number of replaced contents kept for rollback per bag and per named object.
+var BagVersions = 3
+
+// ExpiryWarning is the default time before expiry, when owners of bags and bursts are notified.
+var ExpiryWarning = 24 * time.Hour
+
+// SmtpRelay is the host:port of a relay sending notification emails. Empty string, if emails are not sent.
+var SmtpRelay = ""
+
+// BurstSandbox is the container engine running burst code, docker or podman.
+// Empty string finds one in the PATH, and it falls back to Linux namespaces, if there is none.
+// Burst code never runs in the host process space.
+var BurstSandbox = ""
+
+// BurstImage is the container image of bursts, if they run with docker or podman.
+// It should have the interpreters preloaded by the taste of the cloud farm.
+var BurstImage = "php:8-cli"
+
+// BurstCpu is the number of cores, BurstMemory is the bytes, and BurstPids is the number of processes a single burst can use.
+var BurstCpu = 1.0
+var BurstMemory = int64(1024 * 1024 * 1024)
+var BurstPids = int64(64)
+
+// BurstCpuTime is the cpu time a single burst run can use. Runs are also limited by their runtime on BurstCpu cores.
+var BurstCpuTime = 5 * time.Second
+
+// BurstOutput is the bytes a single burst run can return. The burst is stopped, when it writes more.
+var BurstOutput = int64(1024 * 1024)
+
+// BurstFuel is the number of instructions a single wasm burst can run. Zero means the cpu time limit only.
+var BurstFuel = int64(1000 * 1000 * 1000)
+
+// BurstModule is the bytes of a wasm module a burst can load from a bag.
+var BurstModule = int64(64 * 1024 * 1024)
+
+// BurstNetwork allows bursts to reach the network. Bursts only get their input and return their output otherwise.
+var BurstNetwork = false
+
+// BurstUser is the host user id of burst code, if the server runs as root.
+var BurstUser = 65534
+
+// BurstCgroup is the cgroup v2 directory, where each burst gets its own cgroup for its limits.
+// Resource limits fall back to rlimits, if it is not writable.
+var BurstCgroup = "/sys/fs/cgroup/wellwish"
+
 var CompanyName = "Example Corporation (SAMPLE)"
 
 var CompanyEmail = "hq@example.com"
@@ -26,7 +26,7 @@ func LogSnapshot(m string, w *bufio.Writer, r *bufio.Reader) {
 	}
 	if m == "PUT" {
 		for {
-			e, k, v := englang.ReadIndexedEntry(*r)
+			e, k, v := englang.ReadIndexedEntry(r)
 			if k == "" {
 				return
 			}